@@ -0,0 +1,290 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package admin implements the HTTP API to control a running fleet: resize
+// it, change the device settings, pause the polling and so on.
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/fleet"
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+const (
+	urlStatus         = "/api/v1/status"
+	urlDevices        = "/api/v1/devices"
+	urlDevicesAdd     = "/api/v1/devices/add"
+	urlDevicesRemove  = "/api/v1/devices/remove"
+	urlSettings       = "/api/v1/settings"
+	urlPause          = "/api/v1/pause"
+	urlResume         = "/api/v1/resume"
+	urlReauthenticate = "/api/v1/reauthenticate"
+	urlDropWebsockets = "/api/v1/websockets/drop"
+)
+
+// Settings is the JSON representation of the device settings, with the
+// intervals in seconds; the missing fields are left unchanged on update.
+type Settings struct {
+	AuthInterval          *float64 `json:"auth_interval,omitempty"`
+	InventoryInterval     *float64 `json:"inventory_interval,omitempty"`
+	UpdateInterval        *float64 `json:"update_interval,omitempty"`
+	DeploymentTime        *float64 `json:"deployment_time,omitempty"`
+	DeploymentFailureRate *float64 `json:"deployment_failure_rate,omitempty"`
+	Paused                *bool    `json:"paused,omitempty"`
+}
+
+// Status of the run.
+type Status struct {
+	Devices  int64     `json:"devices"`
+	Settings *Settings `json:"settings"`
+}
+
+// Devices is the request body to resize the fleet.
+type Devices struct {
+	Count int64 `json:"count"`
+}
+
+type Server struct {
+	settings *model.Settings
+	fleet    *fleet.Fleet
+}
+
+func NewServer(config *model.RunConfig, fleet *fleet.Fleet) *Server {
+	return &Server{
+		settings: config.Settings,
+		fleet:    fleet,
+	}
+}
+
+// ListenAndServe serves the admin API on the given address.
+func (s *Server) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, s.Handler())
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(urlStatus, s.status)
+	mux.HandleFunc(urlDevices, s.devices)
+	mux.HandleFunc(urlDevicesAdd, s.resize(1))
+	mux.HandleFunc(urlDevicesRemove, s.resize(-1))
+	mux.HandleFunc(urlSettings, s.deviceSettings)
+	mux.HandleFunc(urlPause, s.setPaused(true))
+	mux.HandleFunc(urlResume, s.setPaused(false))
+	mux.HandleFunc(urlReauthenticate, s.action("re-authenticating all the devices",
+		s.fleet.Reauthenticate))
+	mux.HandleFunc(urlDropWebsockets, s.action("dropping all the websockets",
+		s.fleet.DropWebsockets))
+	return mux
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.getStatus())
+}
+
+func (s *Server) getStatus() *Status {
+	return &Status{
+		Devices:  s.fleet.Size(),
+		Settings: newSettings(s.settings.Get()),
+	}
+}
+
+// devices returns the number of devices or, on PUT, resizes the fleet to
+// the given number of devices.
+func (s *Server) devices(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		devices := &Devices{}
+		if !readJSON(w, r, devices) {
+			return
+		}
+		s.scale(w, devices.Count)
+		return
+	}
+	writeJSON(w, http.StatusOK, &Devices{Count: s.fleet.Size()})
+}
+
+// resize adds (sign 1) or removes (sign -1) the given number of devices.
+func (s *Server) resize(sign int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		devices := &Devices{}
+		if !readJSON(w, r, devices) {
+			return
+		}
+		size := s.fleet.Size() + sign*devices.Count
+		if size < 0 {
+			size = 0
+		}
+		s.scale(w, size)
+	}
+}
+
+func (s *Server) scale(w http.ResponseWriter, size int64) {
+	if size < 0 {
+		writeError(w, http.StatusBadRequest, errors.New("negative count"))
+		return
+	}
+	log.Infof("admin: scaling the fleet to %d devices", size)
+	err := s.fleet.Scale(size)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &Devices{Count: s.fleet.Size()})
+}
+
+func (s *Server) deviceSettings(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPatch) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, newSettings(s.settings.Get()))
+		return
+	}
+	settings := &Settings{}
+	if !readJSON(w, r, settings) {
+		return
+	}
+	err := settings.validate()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	values := s.settings.Update(settings.apply)
+	log.Infof("admin: settings updated: %+v", values)
+	// the pending polls would otherwise keep the previous intervals
+	s.fleet.Reschedule()
+	writeJSON(w, http.StatusOK, newSettings(values))
+}
+
+func (s *Server) setPaused(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		s.settings.Update(func(values *model.SettingsValues) {
+			values.Paused = paused
+		})
+		log.Infof("admin: polling paused: %t", paused)
+		writeJSON(w, http.StatusOK, s.getStatus())
+	}
+}
+
+func (s *Server) action(description string, fn func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodPost) {
+			return
+		}
+		log.Infof("admin: %s", description)
+		fn()
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func newSettings(values model.SettingsValues) *Settings {
+	seconds := func(d time.Duration) *float64 {
+		value := d.Seconds()
+		return &value
+	}
+	return &Settings{
+		AuthInterval:          seconds(values.AuthInterval),
+		InventoryInterval:     seconds(values.InventoryInterval),
+		UpdateInterval:        seconds(values.UpdateInterval),
+		DeploymentTime:        seconds(values.DeploymentTime),
+		DeploymentFailureRate: &values.DeploymentFailureRate,
+		Paused:                &values.Paused,
+	}
+}
+
+func (s *Settings) validate() error {
+	for _, interval := range []*float64{
+		s.AuthInterval,
+		s.InventoryInterval,
+		s.UpdateInterval,
+	} {
+		if interval != nil && *interval <= 0 {
+			return errors.New("the intervals must be positive")
+		}
+	}
+	if s.DeploymentTime != nil && *s.DeploymentTime < 0 {
+		return errors.New("the deployment time can't be negative")
+	}
+	if s.DeploymentFailureRate != nil &&
+		(*s.DeploymentFailureRate < 0 || *s.DeploymentFailureRate > 1) {
+		return errors.New("the deployment failure rate must be between 0 and 1")
+	}
+	return nil
+}
+
+func (s *Settings) apply(values *model.SettingsValues) {
+	setDuration := func(target *time.Duration, seconds *float64) {
+		if seconds != nil {
+			*target = time.Duration(*seconds * float64(time.Second))
+		}
+	}
+	setDuration(&values.AuthInterval, s.AuthInterval)
+	setDuration(&values.InventoryInterval, s.InventoryInterval)
+	setDuration(&values.UpdateInterval, s.UpdateInterval)
+	setDuration(&values.DeploymentTime, s.DeploymentTime)
+	if s.DeploymentFailureRate != nil {
+		values.DeploymentFailureRate = *s.DeploymentFailureRate
+	}
+	if s.Paused != nil {
+		values.Paused = *s.Paused
+	}
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	writeError(w, http.StatusMethodNotAllowed,
+		errors.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.Wrap(err, "invalid request body"))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
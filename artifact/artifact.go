@@ -0,0 +1,105 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package artifact reads the header of the Mender Artifacts, which is all the
+// devices need to know about the updates they emulate.
+package artifact
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	headerName   = "header.tar.gz"
+	typeInfoName = "headers/0000/type-info"
+	metaDataName = "headers/0000/meta-data"
+)
+
+var ErrNoHeader = errors.New("the artifact has no gzip-compressed header")
+
+// Header is the header of the first payload of an artifact.
+type Header struct {
+	// Type is the type of the payload, e.g. rootfs-image
+	Type string
+	// MetaData is the meta-data of the payload, if any
+	MetaData map[string]interface{}
+}
+
+type typeInfo struct {
+	Type string `json:"type"`
+}
+
+// ReadHeader reads the artifact up to its header, and returns the header
+// of the first payload.
+func ReadHeader(r io.Reader) (*Header, error) {
+	archive := tar.NewReader(r)
+	for {
+		entry, err := archive.Next()
+		if err == io.EOF {
+			return nil, ErrNoHeader
+		} else if err != nil {
+			return nil, errors.Wrap(err, "invalid artifact")
+		}
+		if entry.Name == headerName {
+			break
+		}
+	}
+	compressed, err := gzip.NewReader(archive)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid artifact header")
+	}
+	defer compressed.Close()
+	return readHeader(tar.NewReader(compressed))
+}
+
+func readHeader(archive *tar.Reader) (*Header, error) {
+	header := &Header{}
+	for {
+		entry, err := archive.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "invalid artifact header")
+		}
+		switch entry.Name {
+		case typeInfoName:
+			info := &typeInfo{}
+			err = decode(archive, info)
+			header.Type = info.Type
+		case metaDataName:
+			err = decode(archive, &header.MetaData)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid artifact header: %s", entry.Name)
+		}
+	}
+	if header.Type == "" {
+		return nil, errors.New("invalid artifact header: no payload type")
+	}
+	return header, nil
+}
+
+func decode(r io.Reader, v interface{}) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
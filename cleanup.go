@@ -0,0 +1,127 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/client"
+	"github.com/mendersoftware/mender-stress-test-client/management"
+	"github.com/mendersoftware/mender-stress-test-client/model"
+	"github.com/mendersoftware/mender-stress-test-client/transport"
+)
+
+func cleanup(config *model.CleanupConfig) error {
+	tlsConfig, err := transport.NewTLSConfig(&config.TLS)
+	if err != nil {
+		return err
+	}
+	mgmt := management.NewClient(config.ServerURL, config.Token, tlsConfig)
+	if config.Token == "" {
+		err := mgmt.Login(config.Username, config.Password)
+		if err != nil {
+			return err
+		}
+	}
+
+	devices, err := mgmt.ListDevices()
+	if err != nil {
+		return err
+	}
+
+	match, err := cleanupMatcher(config)
+	if err != nil {
+		return err
+	}
+	selected := []*management.Device{}
+	for _, device := range devices {
+		if match(device) {
+			selected = append(selected, device)
+		}
+	}
+	log.Infof("%d of %d devices created by the stress test client", len(selected),
+		len(devices))
+
+	if config.DryRun {
+		for _, device := range selected {
+			fmt.Printf("%s\t%s\t%s\n", device.ID, device.Identity("mac"),
+				device.Status)
+		}
+		return nil
+	}
+
+	var failed int64
+	var wg sync.WaitGroup
+	queue := make(chan *management.Device)
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for device := range queue {
+				err := mgmt.DecommissionDevice(device.ID)
+				if err != nil {
+					log.Errorf("[%s] %s", device.Identity("mac"), err)
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				log.Debugf("[%s] %-40s %s", device.Identity("mac"),
+					"decommissioned", device.ID)
+			}
+		}()
+	}
+	for _, device := range selected {
+		queue <- device
+	}
+	close(queue)
+	wg.Wait()
+
+	log.Infof("decommissioned %d devices", int64(len(selected))-failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to decommission %d devices", failed)
+	}
+	return nil
+}
+
+// cleanupMatcher selects devices by identity markers, if given, otherwise
+// by the MAC addresses the run command generates for the given prefix,
+// index offset and count, followed by the given number of arrivals.
+func cleanupMatcher(config *model.CleanupConfig) (func(*management.Device) bool, error) {
+	if len(config.IdentityMarkers) > 0 {
+		return func(device *management.Device) bool {
+			for k, v := range config.IdentityMarkers {
+				if device.Identity(k) != v {
+					return false
+				}
+			}
+			return true
+		}, nil
+	}
+
+	_, err := client.GetMACAddressFromPrefixAndIndex(config.MACAddressPrefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	first := config.IndexOffset
+	end := config.IndexOffset + config.Count + config.ArrivalCount
+	return func(device *management.Device) bool {
+		index, err := client.GetIndexFromMACAddress(config.MACAddressPrefix,
+			device.Identity("mac"))
+		return err == nil && index >= first && index < end
+	}, nil
+}
@@ -15,29 +15,33 @@
 package client
 
 import (
-	"bytes"
+	"context"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	mathrand "math/rand"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	wslib "github.com/gorilla/websocket"
 	"github.com/mendersoftware/go-lib-micro/ws"
-	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"github.com/vmihailenco/msgpack/v5"
 
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
 	"github.com/mendersoftware/mender-stress-test-client/model"
+	"github.com/mendersoftware/mender-stress-test-client/netem"
+	"github.com/mendersoftware/mender-stress-test-client/transport"
+	"github.com/mendersoftware/mender-stress-test-client/vfs"
 	"github.com/mendersoftware/mender-stress-test-client/websocket"
 )
 
@@ -45,14 +49,14 @@ const urlAuthRequest = "/api/devices/v1/authentication/auth_requests"
 const urlPutInventory = "/api/devices/v1/inventory/device/attributes"
 const urlDeploymentsNext = "/api/devices/v1/deployments/device/deployments/next"
 const urlDeploymentsStatus = "/api/devices/v1/deployments/device/deployments/{id}/status"
-
-const websocketReconnectionIntervalInSeconds = 60
+const urlDeploymentsLog = "/api/devices/v1/deployments/device/deployments/{id}/log"
 
 const (
 	statusDownloading = "downloading"
 	statusInstalling  = "installing"
 	statusRebooting   = "rebooting"
 	statusSuccess     = "success"
+	statusFailure     = "failure"
 )
 
 const (
@@ -60,16 +64,62 @@ const (
 	attributeDeviceType         = "device_type"
 )
 
-var errUnauthorized = errors.New("unauthorized")
+var ErrUnauthorized = errors.New("unauthorized")
+
+var errDeploymentFailed = errors.New("deployment failed")
+
+// command sent to a running device
+type command int
+
+const (
+	commandReauthenticate command = iota
+	commandDropWebsocket
+	commandReschedule
+)
+
+// websocketTriggerQueue is the number of triggers waiting for the device to
+// be available; the triggers arriving when the queue is full are dropped.
+const websocketTriggerQueue = 8
+
+// WebsocketMessage is a message read from the websocket, with the time it
+// was received.
+type WebsocketMessage struct {
+	Msg      *ws.ProtoMsg
+	Received time.Time
+}
 
 type Client struct {
-	Index               int64
-	MACAddress          string
-	JWTToken            string
-	Config              *model.RunConfig
-	ArtifactName        string
+	Index        int64
+	MACAddress   string
+	JWTToken     string
+	Config       *model.RunConfig
+	ArtifactName string
+	// WebsocketConnection is the current websocket connection; it is only
+	// used on the websocket goroutine, which replaces it on reconnection
 	WebsocketConnection *websocket.Connection
 	Tier                *string
+	HTTPClient          *transport.HTTPClient
+	WebsocketDialer     *wslib.Dialer
+	ClockSkew           time.Duration
+	// PrivateKey and PublicKey are shared by all the devices, unless the
+	// device was replaced with a new key
+	PrivateKey *rsa.PrivateKey
+	PublicKey  []byte
+	commands   chan command
+	state      string
+	shells     map[string]*shellSession
+	files      *vfs.FS
+	downloads  map[string]*download
+	uploads    map[string]*upload
+	forwards   map[string]*forwardedConn
+	// forwardSessions are the port forwarding sessions by ID
+	forwardSessions map[string]*forwardSession
+	// configuration is the configuration applied by the configure add-on
+	configuration map[string]string
+	// monitors and alerts are the state of the monitored services and the
+	// alerts left to send, kept across the authentications
+	monitors []*serviceMonitor
+	alerts   []*model.Alert
 }
 
 type AuthRequest struct {
@@ -79,7 +129,11 @@ type AuthRequest struct {
 	Tier         *string `json:"tier,omitempty"`
 }
 
-func getMACAddressFromPrefixAndIndex(prefix string, index int64) (string, error) {
+// MaxDevices is the number of MAC addresses for a given prefix: the index
+// fills the five last bytes.
+const MaxDevices = 1 << 40
+
+func GetMACAddressFromPrefixAndIndex(prefix string, index int64) (string, error) {
 	prefixNum, err := strconv.ParseUint(prefix, 16, 8)
 	if err != nil {
 		return "", err
@@ -96,174 +150,327 @@ func getMACAddressFromPrefixAndIndex(prefix string, index int64) (string, error)
 		buf[3], buf[4], buf[5]), nil
 }
 
+// GetIndexFromMACAddress returns the index of the client with the given MAC
+// address, or an error if the address doesn't start with the prefix.
+func GetIndexFromMACAddress(prefix string, macAddress string) (int64, error) {
+	prefixNum, err := strconv.ParseUint(prefix, 16, 8)
+	if err != nil {
+		return 0, err
+	}
+	hw, err := net.ParseMAC(macAddress)
+	if err != nil {
+		return 0, err
+	} else if len(hw) != 6 || hw[0] != byte(prefixNum) {
+		return 0, errors.Errorf("%s doesn't start with the prefix %s", macAddress, prefix)
+	}
+	index := int64(0)
+	for _, b := range hw[1:] {
+		index = index<<8 | int64(b)
+	}
+	return index, nil
+}
+
 func NewClient(config *model.RunConfig, index int64) (*Client, error) {
+	return NewClientWithKey(config, index, config.PrivateKey, config.PublicKey)
+}
+
+// NewClientWithKey returns a client authenticating with its own key instead
+// of the shared one, e.g. for a device replaced with a new key; with mutual
+// TLS, its certificate certifies that key.
+func NewClientWithKey(config *model.RunConfig, index int64, privateKey *rsa.PrivateKey,
+	publicKey []byte) (*Client, error) {
 	mathrand.Seed(time.Now().UnixNano() + index)
-	macAddress, err := getMACAddressFromPrefixAndIndex(config.MACAddressPrefix, index)
+	macAddress, err := GetMACAddressFromPrefixAndIndex(config.MACAddressPrefix, index)
 	if err != nil {
 		return nil, err
 	}
 
+	opts := &transport.DeviceOptions{
+		Proxy:         transport.DeviceProxy(config, index),
+		SourceAddress: transport.DeviceSourceAddress(config, index),
+		Network:       netem.Assign(config.NetworkProfiles, index),
+	}
+	if config.CertificateIssuer != nil && privateKey == config.PrivateKey {
+		opts.Certificate, err = config.CertificateIssuer.Certificate(macAddress)
+	} else if config.CertificateIssuer != nil {
+		opts.Certificate, err = config.CertificateIssuer.CertificateForKey(macAddress,
+			privateKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var clockSkew time.Duration
+	if config.LockstepSkew > 0 {
+		clockSkew = time.Duration(mathrand.Int63n(int64(config.LockstepSkew)))
+	}
+
 	return &Client{
-		Index:        index,
-		MACAddress:   macAddress,
-		Config:       config,
-		ArtifactName: config.ArtifactName,
-		Tier:         config.Tier,
+		Index:           index,
+		MACAddress:      macAddress,
+		Config:          config,
+		ArtifactName:    config.ArtifactName,
+		Tier:            config.Tier,
+		HTTPClient:      transport.GetHTTPClient(config, opts),
+		WebsocketDialer: transport.NewWebsocketDialer(config, opts),
+		ClockSkew:       clockSkew,
+		PrivateKey:      privateKey,
+		PublicKey:       publicKey,
+		commands:        make(chan command, 3),
 	}, nil
 }
 
-func (c *Client) Authenticate() error {
+func (c *Client) Authenticate(ctx context.Context) error {
+	body, signature, err := c.authRequest()
+	if err != nil {
+		return err
+	}
+
+	for {
+		err = c.sendAuthRequest(ctx, body, signature)
+		if err != ErrUnauthorized {
+			return err
+		}
+
+		err = sleep(ctx, c.authRetryInterval())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// AuthenticateOnce sends a single authentication request; it returns
+// ErrUnauthorized if the device is not accepted by the server.
+func (c *Client) AuthenticateOnce(ctx context.Context) error {
+	body, signature, err := c.authRequest()
+	if err != nil {
+		return err
+	}
+	return c.sendAuthRequest(ctx, body, signature)
+}
+
+// IsAuthenticated returns true if the device holds a JWT token.
+func (c *Client) IsAuthenticated() bool {
+	return c.JWTToken != ""
+}
+
+func (c *Client) authRequest() ([]byte, string, error) {
 	identityData := map[string]string{"mac": c.MACAddress}
 	for k, v := range c.Config.ExtraIdentity {
 		identityData[k] = v
 	}
 	identityDataBytes, err := json.Marshal(identityData)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
 	authRequest := &AuthRequest{
 		IdentityData: string(identityDataBytes),
-		PublicKey:    string(c.Config.PublicKey),
+		PublicKey:    string(c.PublicKey),
 		TenantToken:  c.Config.TenantToken,
 		Tier:         c.Tier,
 	}
 
 	body, err := json.Marshal(authRequest)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
 	hashed := sha256.Sum256(body)
-	bodyHash, err := rsa.SignPKCS1v15(rand.Reader, c.Config.PrivateKey,
+	bodyHash, err := rsa.SignPKCS1v15(rand.Reader, c.PrivateKey,
 		crypto.SHA256, hashed[:])
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-	signature := base64.StdEncoding.EncodeToString(bodyHash)
-
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: true}
-
-	for {
-		buff := bytes.NewBuffer(body)
-		req, err := http.NewRequest(http.MethodPost, c.Config.ServerURL+
-			urlAuthRequest, buff)
-		if err != nil {
-			return err
-		}
-		req.Header.Add("Content-Type", "application/json")
-		req.Header.Add("X-MEN-Signature", signature)
-
-		start := time.Now()
-		response, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return err
-		}
-		elapsed := time.Since(start).Milliseconds()
+	return body, base64.StdEncoding.EncodeToString(bodyHash), nil
+}
 
-		log.Debugf("[%s] %-40s %d (%6d ms)", c.MACAddress, "authentication",
-			response.StatusCode, elapsed)
+func (c *Client) sendAuthRequest(ctx context.Context, body []byte, signature string) error {
+	c.JWTToken = ""
+	req, err := c.newRequest(ctx, http.MethodPost, urlAuthRequest, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("X-MEN-Signature", signature)
 
-		if response.StatusCode == http.StatusOK {
-			defer response.Body.Close() //nolint:errcheck
-			body, err := io.ReadAll(response.Body)
-			if err != nil {
-				return err
-			}
-			c.JWTToken = string(body)
-			return nil
-		} else {
-			_ = response.Body.Close()
-		}
+	response, err := c.do(req, OperationAuthentication, OperationAuthentication)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close() //nolint:errcheck
 
-		time.Sleep(c.Config.AuthInterval)
+	if response.StatusCode != http.StatusOK {
+		return ErrUnauthorized
+	}
+	token, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
 	}
+	c.JWTToken = string(token)
+	return nil
 }
 
-func (c *Client) Run() {
-	inventoryTicker := time.NewTicker(c.Config.InventoryInterval)
-	updateTicker := time.NewTicker(c.Config.UpdateInterval)
+// Run runs the device until the context is canceled.
+func (c *Client) Run(ctx context.Context) {
+	inventorySchedule := c.newSchedule(c.inventoryInterval,
+		c.Config.InventoryIntervalDistribution)
+	inventoryTimer := time.NewTimer(inventorySchedule.next(time.Now()))
+	defer inventoryTimer.Stop()
+	updateSchedule := c.newSchedule(c.updateInterval,
+		c.Config.UpdateIntervalDistribution)
+	updateTimer := time.NewTimer(updateSchedule.next(time.Now()))
+	defer updateTimer.Stop()
+
+	triggers := make(chan *WebsocketMessage, websocketTriggerQueue)
+	stopWebsocket := func() {}
+	stopMonitor := func() {}
+	defer func() {
+		stopWebsocket()
+		stopMonitor()
+		c.setState("")
+	}()
 
 auth:
-	err := c.Authenticate()
-	if err != nil {
+	stopWebsocket()
+	stopMonitor()
+	c.setState(StateAuthenticating)
+	err := c.Authenticate(ctx)
+	if ctx.Err() != nil {
+		return
+	} else if err != nil {
 		log.Errorf("[%s] %s", c.MACAddress, err)
-		time.Sleep(c.Config.AuthInterval)
+		if sleep(ctx, c.authRetryInterval()) != nil {
+			return
+		}
 		goto auth
 	}
 
-	websocketMessages := make(chan *ws.ProtoMsg, 1)
+	c.setState(StateIdle)
 	if c.Config.Websocket {
-		go c.StartWebsocket(websocketMessages)
+		stopWebsocket = c.startWebsocket(ctx, triggers)
 	}
+	stopMonitor = c.startMonitor(ctx)
 
-	err = c.SendInventory()
-	if err == errUnauthorized {
-		goto auth
-	}
-	err = c.UpdateCheck()
-	if err == errUnauthorized {
+	err = c.initialPolls(ctx)
+	if err == ErrUnauthorized {
 		goto auth
 	}
 
-	inventoryTicker.Reset(c.Config.InventoryInterval)
-	updateTicker.Reset(c.Config.UpdateInterval)
+	resetTimer(inventoryTimer, inventorySchedule.next(time.Now()))
+	resetTimer(updateTimer, updateSchedule.next(time.Now()))
 
 	for {
 		select {
-		case <-inventoryTicker.C:
-			err = c.SendInventory()
-			if err == errUnauthorized {
-				if c.Config.Websocket {
-					_ = c.CloseWebsocket()
-				}
+		case <-ctx.Done():
+			return
+		case <-inventoryTimer.C:
+			err = c.poll(ctx, c.SendInventory)
+			inventoryTimer.Reset(inventorySchedule.next(time.Now()))
+		case <-updateTimer.C:
+			err = c.poll(ctx, c.UpdateCheck)
+			updateTimer.Reset(updateSchedule.next(time.Now()))
+		case msg := <-triggers:
+			err = c.handleMenderClientMessage(ctx, msg.Msg, msg.Received)
+		case cmd := <-c.commands:
+			switch cmd {
+			case commandReauthenticate:
 				goto auth
-			}
-		case <-updateTicker.C:
-			err = c.UpdateCheck()
-			if err == errUnauthorized {
+			case commandDropWebsocket:
 				if c.Config.Websocket {
-					_ = c.CloseWebsocket()
+					stopWebsocket()
+					stopWebsocket = c.startWebsocket(ctx, triggers)
 				}
-				goto auth
-			}
-		case msg := <-websocketMessages:
-			log.Infof("[%s] websocket msg: %v", c.MACAddress, msg)
-			if msg.Header.Proto == ws.ProtoTypeShell &&
-				msg.Header.MsgType == wsshell.MessageTypeSpawnShell {
-				_ = c.WebsocketConnection.WriteMessage(&ws.ProtoMsg{
-					Header: ws.ProtoHdr{
-						Proto:     msg.Header.Proto,
-						MsgType:   msg.Header.MsgType,
-						SessionID: msg.Header.SessionID,
-						Properties: map[string]interface{}{
-							"status": wsshell.ErrorMessage,
-						},
-					},
-					Body: []byte("not supported by mender-stress-test-client"),
-				})
-			} else {
-				b, _ := msgpack.Marshal(ws.Error{
-					Error:        "handshake rejected",
-					MessageProto: ws.ProtoTypeControl,
-					MessageType:  ws.MessageTypeOpen,
-					Close:        true,
-				})
-				_ = c.WebsocketConnection.WriteMessage(&ws.ProtoMsg{
-					Header: ws.ProtoHdr{
-						Proto:     ws.ProtoTypeControl,
-						MsgType:   ws.MessageTypeError,
-						SessionID: msg.Header.SessionID,
-					},
-					Body: b,
-				})
+			case commandReschedule:
+				resetTimer(inventoryTimer, inventorySchedule.next(time.Now()))
+				resetTimer(updateTimer, updateSchedule.next(time.Now()))
 			}
 		}
+		if err == ErrUnauthorized {
+			goto auth
+		}
 	}
 }
 
-func (c *Client) SendInventory() error {
+// initialPolls sends the polls which follow the authentication.
+func (c *Client) initialPolls(ctx context.Context) error {
+	requests := []func(ctx context.Context) error{c.SendInventory}
+	if c.Config.Configure {
+		requests = append(requests, c.SendConfiguration)
+	}
+	requests = append(requests, c.UpdateCheck)
+	for _, request := range requests {
+		err := c.poll(ctx, request)
+		if err == ErrUnauthorized {
+			return err
+		}
+	}
+	return nil
+}
+
+// poll sends the request, unless the polling is paused.
+func (c *Client) poll(ctx context.Context, request func(ctx context.Context) error) error {
+	if c.Config.Settings.Get().Paused {
+		return nil
+	}
+	return request(ctx)
+}
+
+// Reauthenticate makes the device drop its token and authenticate again.
+func (c *Client) Reauthenticate() {
+	c.sendCommand(commandReauthenticate)
+}
+
+// DropWebsocket closes the websocket connection of the device, which
+// reconnects right away.
+func (c *Client) DropWebsocket() {
+	c.sendCommand(commandDropWebsocket)
+}
+
+// Reschedule makes the device apply the current poll intervals to the
+// pending polls, instead of waiting for them to fire.
+func (c *Client) Reschedule() {
+	c.sendCommand(commandReschedule)
+}
+
+func (c *Client) sendCommand(cmd command) {
+	select {
+	case c.commands <- cmd:
+	default:
+	}
+}
+
+// handleWebsocketMessage handles the message received at the given time on
+// the websocket goroutine, so that the sessions don't wait for the polls and
+// the deployments; the triggers are queued for the REST requests instead.
+func (c *Client) handleWebsocketMessage(msg *ws.ProtoMsg, received time.Time,
+	triggers chan<- *WebsocketMessage) {
+	log.Debugf("[%s] websocket msg: %v", c.MACAddress, msg.Header)
+	switch msg.Header.Proto {
+	case ws.ProtoTypeControl:
+		c.handleControlMessage(msg)
+	case ws.ProtoTypeShell:
+		c.handleShellMessage(msg, received)
+	case ws.ProtoTypeFileTransfer:
+		c.handleFileTransferMessage(msg)
+	case ws.ProtoTypePortForward:
+		c.handlePortForwardMessage(msg)
+	case ws.ProtoTypeMenderClient:
+		if !isTrigger(msg) {
+			c.sendError(msg, "unknown message type", false)
+			return
+		}
+		select {
+		case triggers <- &WebsocketMessage{Msg: msg, Received: received}:
+		default:
+			metrics.GetCounter(MetricTriggersDropped).Inc()
+			log.Debugf("[%s] %-40s", c.MACAddress, "trigger dropped")
+		}
+	default:
+		c.sendError(msg, "protocol not supported by mender-stress-test-client", true)
+	}
+}
+
+func (c *Client) SendInventory(ctx context.Context) error {
 	attributes := []*model.InventoryAttribute{
 		{
 			Name:  attributeRootfsImageVersion,
@@ -302,42 +509,37 @@ func (c *Client) SendInventory() error {
 		})
 	}
 
+	if c.Config.Configure {
+		attributes = append(attributes, c.configurationAttributes()...)
+	}
+
 	body, err := json.Marshal(attributes)
 	if err != nil {
 		log.Errorf("[%s] %s", c.MACAddress, err)
 		return err
 	}
 
-	req, err := http.NewRequest(http.MethodPut, c.Config.ServerURL+urlPutInventory,
-		bytes.NewBuffer(body))
+	req, err := c.newRequest(ctx, http.MethodPut, urlPutInventory, body)
 	if err != nil {
 		log.Errorf("[%s] %s", c.MACAddress, err)
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", "Bearer "+c.JWTToken)
 
-	start := time.Now()
-	response, err := http.DefaultClient.Do(req)
-	if response != nil {
-		_ = response.Body.Close()
-	}
+	response, err := c.do(req, OperationSendInventory, OperationSendInventory)
 	if err != nil {
 		log.Errorf("[%s] %s", c.MACAddress, err)
 		return err
 	}
-	elapsed := time.Since(start).Milliseconds()
+	_ = response.Body.Close()
 
-	log.Debugf("[%s] %-40s %d (%6d ms)", c.MACAddress, "send-inventory",
-		response.StatusCode, elapsed)
 	if response.StatusCode == http.StatusUnauthorized {
-		return errUnauthorized
+		return ErrUnauthorized
 	}
 
 	return nil
 }
 
-func (c *Client) UpdateCheck() error {
+func (c *Client) UpdateCheck(ctx context.Context) error {
 	deploymentNextRequest := &model.DeploymentNextRequest{
 		DeviceType:          c.Config.DeviceType,
 		ArtifactName:        c.Config.ArtifactName,
@@ -349,30 +551,22 @@ func (c *Client) UpdateCheck() error {
 		return err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, c.Config.ServerURL+urlDeploymentsNext,
-		bytes.NewBuffer(body))
+	req, err := c.newRequest(ctx, http.MethodPost, urlDeploymentsNext, body)
 	if err != nil {
 		log.Errorf("[%s] %s", c.MACAddress, err)
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", "Bearer "+c.JWTToken)
 
-	start := time.Now()
-	response, err := http.DefaultClient.Do(req)
+	response, err := c.do(req, OperationUpdateCheck, OperationUpdateCheck)
 	if err != nil {
 		log.Errorf("[%s] %s", c.MACAddress, err)
 		return err
 	}
-	elapsed := time.Since(start).Milliseconds()
 	defer response.Body.Close() //nolint:errcheck
 
-	log.Debugf("[%s] %-40s %d (%6d ms)", c.MACAddress, "update-check",
-		response.StatusCode, elapsed)
-
 	// unauthorized
 	if response.StatusCode == http.StatusUnauthorized {
-		return errUnauthorized
+		return ErrUnauthorized
 	}
 
 	// received deployment
@@ -390,8 +584,19 @@ func (c *Client) UpdateCheck() error {
 			return err
 		}
 
-		err = c.Deployment(response.ID)
-		if err != nil {
+		if c.Config.Configure {
+			configured, err := c.configure(ctx, response)
+			if configured || err != nil {
+				return err
+			}
+		}
+
+		c.setState(StateDeploying)
+		err = c.Deployment(ctx, response.ID)
+		c.setState(StateIdle)
+		if err == errDeploymentFailed {
+			return nil
+		} else if err != nil {
 			return err
 		}
 
@@ -399,7 +604,7 @@ func (c *Client) UpdateCheck() error {
 		if response.Artifact != nil {
 			c.ArtifactName = response.Artifact.Name
 		}
-		err = c.SendInventory()
+		err = c.SendInventory(ctx)
 		if err != nil {
 			return err
 		}
@@ -407,83 +612,198 @@ func (c *Client) UpdateCheck() error {
 	return nil
 }
 
-func (c *Client) Deployment(deploymentID string) error {
-	statusURL := strings.Replace(urlDeploymentsStatus, "{id}", deploymentID, 1)
-
+func (c *Client) Deployment(ctx context.Context, deploymentID string) error {
 	statuses := []string{
 		statusDownloading,
 		statusInstalling,
 		statusRebooting,
 		statusSuccess,
 	}
+	start := time.Now()
+	failed := mathrand.Float64() < c.Config.Settings.Get().DeploymentFailureRate
+	if failed {
+		statuses = []string{
+			statusDownloading,
+			statusInstalling,
+			statusFailure,
+		}
+	}
 
 	for _, status := range statuses {
-		deploymentNextRequest := &model.DeploymentStatus{
-			Status: status,
+		var err error
+		if status == statusFailure {
+			err = c.sendDeploymentFailure(ctx, deploymentID, start)
+		} else {
+			err = c.sendDeploymentStatus(ctx, deploymentID, status)
 		}
-
-		body, err := json.Marshal(deploymentNextRequest)
 		if err != nil {
-			log.Errorf("[%s] %s", c.MACAddress, err)
 			return err
 		}
 
-		req, err := http.NewRequest(http.MethodPut, c.Config.ServerURL+statusURL,
-			bytes.NewBuffer(body))
+		err = sleep(ctx, c.deploymentStepTime())
 		if err != nil {
-			log.Errorf("[%s] %s", c.MACAddress, err)
 			return err
 		}
-		req.Header.Add("Content-Type", "application/json")
-		req.Header.Add("Authorization", "Bearer "+c.JWTToken)
+	}
+	if failed {
+		metrics.GetCounter(MetricDeployments, "result", DeploymentFailure).Inc()
+		return errDeploymentFailed
+	}
+	metrics.GetCounter(MetricDeployments, "result", DeploymentSuccess).Inc()
+	return nil
+}
 
-		start := time.Now()
-		response, err := http.DefaultClient.Do(req)
-		if response != nil {
-			_ = response.Body.Close()
-		}
-		if err != nil {
-			log.Errorf("[%s] %s", c.MACAddress, err)
-			return err
-		}
-		elapsed := time.Since(start).Milliseconds()
+func (c *Client) sendDeploymentStatus(ctx context.Context, deploymentID string,
+	status string) error {
+	statusURL := strings.Replace(urlDeploymentsStatus, "{id}", deploymentID, 1)
+	deploymentNextRequest := &model.DeploymentStatus{
+		Status: status,
+	}
 
-		log.Debugf("[%s] %-40s %d (%6d ms)", c.MACAddress, "deployment-status: "+status,
-			response.StatusCode, elapsed)
+	body, err := json.Marshal(deploymentNextRequest)
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
 
-		// unauthorized
-		if response.StatusCode == http.StatusUnauthorized {
-			return errUnauthorized
-		}
+	req, err := c.newRequest(ctx, http.MethodPut, statusURL, body)
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+
+	response, err := c.do(req, operationDeploymentStatus,
+		operationDeploymentStatus+": "+status)
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+	_ = response.Body.Close()
 
-		time.Sleep(c.Config.DeploymentTime)
+	// unauthorized
+	if response.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
 	}
 	return nil
 }
 
-func (c *Client) StartWebsocket(websocketMessages chan *ws.ProtoMsg) {
-	interval := websocketReconnectionIntervalInSeconds * time.Second
+// startWebsocket keeps the websocket connected in the background; the
+// returned function closes it, with its sessions, and waits for the goroutine
+// to return.
+func (c *Client) startWebsocket(ctx context.Context,
+	triggers chan<- *WebsocketMessage) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.StartWebsocket(ctx, triggers)
+		c.closeShells()
+		c.closeFileTransfers()
+		c.closePortForwards("")
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// StartWebsocket keeps the websocket connected until the context is
+// canceled, reconnecting according to the reconnect strategy; the sessions
+// are handled on the calling goroutine, and the triggers sent to the channel.
+func (c *Client) StartWebsocket(ctx context.Context, triggers chan<- *WebsocketMessage) {
+	attempt := 0
+	// disconnected is the time of the last disconnection or, before the
+	// first connection, of the first failed attempt
+	var disconnected time.Time
 	for {
-		err := c.OpenWebsocket()
-		if err != nil {
-			log.Errorf("[%s] %s", c.MACAddress, err)
-			time.Sleep(interval)
-			continue
+		err := c.OpenWebsocket(ctx)
+		if ctx.Err() != nil {
+			return
 		}
-		for {
-			msg, err := c.WebsocketConnection.ReadMessage()
+		if !disconnected.IsZero() {
+			result := reconnectSuccess
 			if err != nil {
-				_ = c.CloseWebsocket()
-				time.Sleep(interval)
-				break
+				result = reconnectFailure
+			}
+			metrics.GetCounter(MetricWebsocketReconnects, "result", result).Inc()
+		}
+		if err == nil {
+			if !disconnected.IsZero() {
+				metrics.GetHistogram(MetricWebsocketReconnectTime).Observe(
+					time.Since(disconnected))
+			}
+			attempt = 0
+			c.readWebsocket(ctx, triggers)
+			if ctx.Err() != nil {
+				return
+			}
+			disconnected = time.Now()
+		} else {
+			log.Errorf("[%s] %s", c.MACAddress, err)
+			if disconnected.IsZero() {
+				disconnected = time.Now()
+			}
+		}
+		if sleep(ctx, c.reconnectDelay(attempt)) != nil {
+			return
+		}
+		attempt++
+	}
+}
+
+// readWebsocket handles the messages from the websocket until the connection
+// breaks or the context is canceled.
+func (c *Client) readWebsocket(ctx context.Context, triggers chan<- *WebsocketMessage) {
+	connected := metrics.GetGauge(MetricWebsockets)
+	connected.Inc()
+	defer connected.Dec()
+
+	// the goroutine closing the connection holds its own reference: the
+	// field is replaced on the next connection, maybe before it returns
+	conn := c.WebsocketConnection
+	var forced int32
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		var disconnect <-chan time.Time
+		if c.Config.WebsocketDisconnectInterval > 0 {
+			timer := time.NewTimer(c.disconnectAfter())
+			defer timer.Stop()
+			disconnect = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			_ = c.closeWebsocket(conn)
+		case <-disconnect:
+			log.Debugf("[%s] %-40s", c.MACAddress, "forcing a websocket disconnection")
+			atomic.StoreInt32(&forced, 1)
+			_ = c.closeWebsocket(conn)
+		case <-stop:
+		}
+	}()
+
+	for {
+		msg, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			reason := disconnectClosed
+			if atomic.LoadInt32(&forced) == 1 {
+				reason = disconnectForced
+			} else {
+				_ = c.closeWebsocket(conn)
 			}
-			websocketMessages <- msg
+			metrics.GetCounter(MetricWebsocketDisconnects, "reason", reason).Inc()
+			return
 		}
+		c.handleWebsocketMessage(msg, time.Now(), triggers)
 	}
 }
 
-func (c *Client) OpenWebsocket() error {
-	conn, err := websocket.NewConnection(c.Config.ServerURL, c.JWTToken)
+func (c *Client) OpenWebsocket(ctx context.Context) error {
+	conn, err := websocket.NewConnection(ctx, c.Config.ServerURL, c.JWTToken,
+		c.WebsocketDialer)
 	if err != nil {
 		return err
 	}
@@ -494,6 +814,10 @@ func (c *Client) OpenWebsocket() error {
 }
 
 func (c *Client) CloseWebsocket() error {
+	return c.closeWebsocket(c.WebsocketConnection)
+}
+
+func (c *Client) closeWebsocket(conn *websocket.Connection) error {
 	log.Debugf("[%s] %-40s", c.MACAddress, "websocket disconnected")
-	return c.WebsocketConnection.Close()
+	return conn.Close()
 }
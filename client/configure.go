@@ -0,0 +1,224 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/artifact"
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+const urlDeviceConfiguration = "/api/devices/v1/deviceconfig/configuration"
+
+// urlConfigurationDownload is the path of the artifacts the deployments
+// service generates for the configuration deployments
+const urlConfigurationDownload = "/api/devices/v1/deployments/download/configuration/"
+
+const (
+	operationConfiguration    = "configuration"
+	operationArtifactDownload = "artifact-download"
+)
+
+// MetricConfigurations counts the configuration deployments by result.
+const MetricConfigurations = "configurations_total"
+
+const (
+	// payloadTypeConfigure is the payload type of the configuration
+	// deployments
+	payloadTypeConfigure = "mender-configure"
+	// attributeConfigurePrefix is the prefix of the inventory attributes
+	// listing the configuration, as added by the configure add-on
+	attributeConfigurePrefix = "mender-configure."
+)
+
+// currentConfiguration returns the applied configuration, which starts with
+// the configured attributes.
+func (c *Client) currentConfiguration() map[string]string {
+	if c.configuration == nil {
+		c.configuration = map[string]string{}
+		for _, attr := range c.Config.ConfigureAttributes {
+			parts := strings.SplitN(attr, ":", 2)
+			if len(parts) < 2 {
+				continue
+			}
+			values := strings.Split(parts[1], "|")
+			c.configuration[parts[0]] = values[int(c.Index)%len(values)]
+		}
+	}
+	return c.configuration
+}
+
+// configurationAttributes returns the inventory attributes of the applied
+// configuration.
+func (c *Client) configurationAttributes() []*model.InventoryAttribute {
+	configuration := c.currentConfiguration()
+	keys := make([]string, 0, len(configuration))
+	for key := range configuration {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	attributes := make([]*model.InventoryAttribute, 0, len(keys))
+	for _, key := range keys {
+		attributes = append(attributes, &model.InventoryAttribute{
+			Name:  attributeConfigurePrefix + key,
+			Value: configuration[key],
+		})
+	}
+	return attributes
+}
+
+// SendConfiguration reports the applied configuration.
+func (c *Client) SendConfiguration(ctx context.Context) error {
+	body, err := json.Marshal(c.currentConfiguration())
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPut, urlDeviceConfiguration, body)
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+
+	response, err := c.do(req, operationConfiguration, operationConfiguration)
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// fetchConfiguration reads the header of the artifact of the deployment,
+// and returns the configuration if it is a configuration deployment, or nil.
+// Only the artifacts generated for the configuration deployments are
+// downloaded.
+func (c *Client) fetchConfiguration(ctx context.Context,
+	deployment *model.DeploymentNextResponse) (map[string]string, error) {
+	if deployment.Artifact == nil || deployment.Artifact.Source == nil {
+		return nil, nil
+	}
+	uri := deployment.Artifact.Source.URI
+	source, err := url.Parse(uri)
+	if err != nil || !strings.HasPrefix(source.Path, urlConfigurationDownload) {
+		return nil, nil
+	}
+	if strings.HasPrefix(uri, "/") {
+		uri = c.Config.ServerURL + uri
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.do(req, operationArtifactDownload, operationArtifactDownload)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close() //nolint:errcheck
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s: unexpected status code %d",
+			operationArtifactDownload, response.StatusCode)
+	}
+
+	header, err := artifact.ReadHeader(response.Body)
+	if err != nil {
+		return nil, err
+	} else if header.Type != payloadTypeConfigure {
+		return nil, nil
+	}
+	configuration := make(map[string]string, len(header.MetaData))
+	for key, value := range header.MetaData {
+		configuration[key] = fmt.Sprint(value)
+	}
+	return configuration, nil
+}
+
+// ConfigurationDeployment applies the configuration after the apply time,
+// unless it fails, then reports the applied configuration.
+func (c *Client) ConfigurationDeployment(ctx context.Context, deploymentID string,
+	configuration map[string]string) error {
+	start := time.Now()
+	failed := mathrand.Float64() < c.Config.ConfigureFailureRate
+	for _, status := range []string{statusDownloading, statusInstalling} {
+		err := c.sendDeploymentStatus(ctx, deploymentID, status)
+		if err != nil {
+			return err
+		}
+	}
+	err := sleep(ctx, c.Config.ConfigureApplyTime)
+	if err != nil {
+		return err
+	}
+
+	if failed {
+		err = c.sendDeploymentFailure(ctx, deploymentID, start)
+		if err != nil {
+			return err
+		}
+		metrics.GetCounter(MetricConfigurations, "result", DeploymentFailure).Inc()
+		return errDeploymentFailed
+	}
+	c.configuration = configuration
+	err = c.sendDeploymentStatus(ctx, deploymentID, statusSuccess)
+	if err != nil {
+		return err
+	}
+	metrics.GetCounter(MetricConfigurations, "result", DeploymentSuccess).Inc()
+	log.Debugf("[%s] %-40s", c.MACAddress, "configuration applied")
+	return c.SendConfiguration(ctx)
+}
+
+// configure runs the deployment if it is a configuration deployment, and
+// returns whether it was one; a configuration artifact which can't be read
+// fails the deployment.
+func (c *Client) configure(ctx context.Context,
+	deployment *model.DeploymentNextResponse) (bool, error) {
+	start := time.Now()
+	configuration, err := c.fetchConfiguration(ctx, deployment)
+	if err != nil && ctx.Err() == nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		metrics.GetCounter(MetricConfigurations, "result", DeploymentFailure).Inc()
+		return true, c.sendDeploymentFailure(ctx, deployment.ID, start)
+	} else if err != nil || configuration == nil {
+		return err != nil, err
+	}
+	c.setState(StateDeploying)
+	err = c.ConfigurationDeployment(ctx, deployment.ID, configuration)
+	c.setState(StateIdle)
+	if err == errDeploymentFailed {
+		return true, nil
+	} else if err != nil {
+		return true, err
+	}
+	return true, c.SendInventory(ctx)
+}
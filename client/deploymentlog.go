@@ -0,0 +1,140 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+// levels of the deployment log messages
+const (
+	logLevelDebug   = "debug"
+	logLevelInfo    = "info"
+	logLevelWarning = "warning"
+	logLevelError   = "error"
+)
+
+// deploymentLogLines are the messages of the update, repeated to fill the
+// log; the errors which end the log are in deploymentLogErrors.
+var deploymentLogLines = []model.DeploymentLogMessage{
+	{Level: logLevelInfo, Message: "Running Mender client version: 3.5.0"},
+	{Level: logLevelDebug, Message: "State transition: update-fetch [Download_Enter] -> " +
+		"update-store [Download_Enter]"},
+	{Level: logLevelInfo, Message: "Installer: authenticated digital signature of artifact"},
+	{Level: logLevelDebug, Message: "Update module output: Downloading the payload"},
+	{Level: logLevelInfo, Message: "Opening device \"/dev/mmcblk0p3\" for writing"},
+	{Level: logLevelDebug, Message: "Wrote 1048576 bytes to the inactive partition"},
+	{Level: logLevelWarning, Message: "Resuming download after a network error"},
+	{Level: logLevelDebug, Message: "State transition: update-store [Download_Enter] -> " +
+		"update-install [ArtifactInstall]"},
+}
+
+var deploymentLogErrors = []model.DeploymentLogMessage{
+	{Level: logLevelError, Message: "Artifact install failed: update module terminated " +
+		"abnormally: exit status 1"},
+	{Level: logLevelError, Message: "Update failed: rolling back to the previous version"},
+}
+
+// deploymentLog returns a log of the given number of lines, and about the
+// given total size of messages unless it is zero, spread between the start
+// and the end of the deployment.
+func deploymentLog(lines int, size int, start, end time.Time) *model.DeploymentLog {
+	messages := make([]model.DeploymentLogMessage, lines)
+	lineSize := size / lines
+	for i := range messages {
+		if j := i - lines + len(deploymentLogErrors); j >= 0 {
+			messages[i] = deploymentLogErrors[j]
+		} else {
+			messages[i] = deploymentLogLines[i%len(deploymentLogLines)]
+		}
+		messages[i].Message = padMessage(messages[i].Message, lineSize)
+		timestamp := start
+		if lines > 1 {
+			timestamp = start.Add(end.Sub(start) * time.Duration(i) /
+				time.Duration(lines-1))
+		}
+		messages[i].Timestamp = timestamp.UTC()
+	}
+	return &model.DeploymentLog{Messages: messages}
+}
+
+// padMessage pads the message with random details, or truncates it, to the
+// given size, if any.
+func padMessage(message string, size int) string {
+	if size <= 0 {
+		return message
+	} else if len(message) >= size {
+		return message[:size]
+	}
+	padding := make([]byte, (size-len(message))/2+1)
+	_, _ = mathrand.Read(padding)
+	return (message + " " + hex.EncodeToString(padding))[:size]
+}
+
+// SendDeploymentLog uploads the log of the failed deployment, unless the
+// log is disabled.
+func (c *Client) SendDeploymentLog(ctx context.Context, deploymentID string,
+	start time.Time) error {
+	if c.Config.DeploymentLogLines <= 0 {
+		return nil
+	}
+	logURL := strings.Replace(urlDeploymentsLog, "{id}", deploymentID, 1)
+	body, err := json.Marshal(deploymentLog(c.Config.DeploymentLogLines,
+		c.Config.DeploymentLogSize, start, time.Now()))
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPut, logURL, body)
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+
+	response, err := c.do(req, operationDeploymentLog, operationDeploymentLog)
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// sendDeploymentFailure uploads the log of the failed deployment, then
+// reports the failure. Like the real clients, the failure is reported even
+// if the upload failed, unless the device must authenticate again.
+func (c *Client) sendDeploymentFailure(ctx context.Context, deploymentID string,
+	start time.Time) error {
+	err := c.SendDeploymentLog(ctx, deploymentID, start)
+	if err == ErrUnauthorized {
+		return err
+	}
+	return c.sendDeploymentStatus(ctx, deploymentID, statusFailure)
+}
@@ -0,0 +1,341 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsft "github.com/mendersoftware/go-lib-micro/ws/filetransfer"
+	log "github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+	"github.com/mendersoftware/mender-stress-test-client/vfs"
+	"github.com/mendersoftware/mender-stress-test-client/websocket"
+)
+
+// metrics of the file transfers
+const (
+	MetricFileTransfers       = "file_transfers"
+	MetricFileTransfersTotal  = "file_transfers_total"
+	MetricFileTransferredSize = "file_transfer_bytes_total"
+)
+
+const (
+	directionDownload = "download"
+	directionUpload   = "upload"
+
+	transferSuccess = "success"
+	transferFailure = "failure"
+)
+
+const (
+	fileChunkSize = 4096
+	// number of chunks sent without being acknowledged
+	fileWindowSize = 8
+	fileAckTimeout = time.Minute
+
+	propertyOffset = "offset"
+
+	defaultFileMode = 0644
+)
+
+// download streams a file to the server in the background.
+type download struct {
+	conn     *websocket.Connection
+	acks     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func (d *download) cancel() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+}
+
+// upload receives a file from the server.
+type upload struct {
+	conn     *websocket.Connection
+	request  *wsft.UploadRequest
+	received int64
+}
+
+func (c *Client) handleFileTransferMessage(msg *ws.ProtoMsg) {
+	c.pruneFileTransfers()
+	if c.files == nil {
+		c.files = vfs.New(c.Config.VirtualFiles, c.MACAddress)
+	}
+	switch msg.Header.MsgType {
+	case wsft.MessageTypeStat:
+		c.statFile(msg)
+	case wsft.MessageTypeGet:
+		c.startDownload(msg)
+	case wsft.MessageTypeACK:
+		if d := c.downloads[msg.Header.SessionID]; d != nil {
+			select {
+			case d.acks <- struct{}{}:
+			default:
+			}
+		}
+	case wsft.MessageTypePut:
+		c.startUpload(msg)
+	case wsft.MessageTypeChunk:
+		c.receiveChunk(msg)
+	case wsft.MessageTypeError:
+		c.abortFileTransfers(msg.Header.SessionID)
+	default:
+		c.fileTransferError(msg, "unknown message type")
+	}
+}
+
+func (c *Client) statFile(msg *ws.ProtoMsg) {
+	request := &wsft.StatFile{}
+	err := msgpack.Unmarshal(msg.Body, request)
+	if err != nil || request.Path == nil {
+		c.fileTransferError(msg, "invalid stat request")
+		return
+	}
+	f, err := c.files.Stat(*request.Path)
+	if err != nil {
+		c.fileTransferError(msg, err.Error())
+		return
+	}
+	mode := uint32(f.Mode)
+	body, _ := msgpack.Marshal(&wsft.FileInfo{
+		Path:    &f.Path,
+		Size:    &f.Size,
+		UID:     &f.UID,
+		GID:     &f.GID,
+		Mode:    &mode,
+		ModTime: &f.ModTime,
+	})
+	c.reply(msg, ws.ProtoTypeFileTransfer, wsft.MessageTypeFileInfo, nil, body)
+}
+
+func (c *Client) startDownload(msg *ws.ProtoMsg) {
+	request := &wsft.GetFile{}
+	err := msgpack.Unmarshal(msg.Body, request)
+	if err != nil || request.Path == nil {
+		c.fileTransferError(msg, "invalid get_file request")
+		return
+	}
+	sessionID := msg.Header.SessionID
+	if c.downloads[sessionID] != nil || c.uploads[sessionID] != nil {
+		c.fileTransferError(msg, "a file transfer is already in progress")
+		return
+	}
+	f, err := c.files.Open(*request.Path)
+	if err != nil {
+		c.fileTransferError(msg, err.Error())
+		return
+	}
+	d := &download{
+		conn: c.WebsocketConnection,
+		acks: make(chan struct{}, fileWindowSize),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if c.downloads == nil {
+		c.downloads = map[string]*download{}
+	}
+	c.downloads[sessionID] = d
+	log.Debugf("[%s] sending the file %s", c.MACAddress, f.Path)
+	go c.sendFile(d, sessionID, f)
+}
+
+// sendFile sends the file in chunks, waiting for the server to acknowledge
+// them when too many are in flight; an empty chunk ends the file.
+func (c *Client) sendFile(d *download, sessionID string, f *vfs.File) {
+	defer close(d.done)
+	active := metrics.GetGauge(MetricFileTransfers, "direction", directionDownload)
+	active.Inc()
+	defer active.Dec()
+	sent := metrics.GetCounter(MetricFileTransferredSize, "direction", directionDownload)
+
+	result := transferFailure
+	defer func() {
+		metrics.GetCounter(MetricFileTransfersTotal, "direction", directionDownload,
+			"result", result).Inc()
+	}()
+
+	buf := make([]byte, fileChunkSize)
+	offset := int64(0)
+	inFlight := 0
+	for {
+		for inFlight >= fileWindowSize {
+			select {
+			case <-d.acks:
+				inFlight--
+			case <-d.stop:
+				return
+			case <-time.After(fileAckTimeout):
+				log.Errorf("[%s] file transfer %s: timeout waiting for the ack",
+					c.MACAddress, f.Path)
+				return
+			}
+		}
+		n := f.ReadAt(buf, offset)
+		err := d.conn.WriteMessage(&ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:      ws.ProtoTypeFileTransfer,
+				MsgType:    wsft.MessageTypeChunk,
+				SessionID:  sessionID,
+				Properties: map[string]interface{}{propertyOffset: offset},
+			},
+			Body: buf[:n],
+		})
+		if err != nil {
+			log.Debugf("[%s] file transfer %s: %s", c.MACAddress, f.Path, err)
+			return
+		} else if n == 0 {
+			break
+		}
+		sent.Add(int64(n))
+		offset += int64(n)
+		inFlight++
+	}
+	result = transferSuccess
+}
+
+func (c *Client) startUpload(msg *ws.ProtoMsg) {
+	request := &wsft.UploadRequest{}
+	err := msgpack.Unmarshal(msg.Body, request)
+	if err != nil || request.Path == nil {
+		c.fileTransferError(msg, "invalid put_file request")
+		return
+	}
+	sessionID := msg.Header.SessionID
+	if c.downloads[sessionID] != nil || c.uploads[sessionID] != nil {
+		c.fileTransferError(msg, "a file transfer is already in progress")
+		return
+	}
+	err = c.files.CheckWrite(*request.Path)
+	if err != nil {
+		c.fileTransferError(msg, err.Error())
+		return
+	}
+	if c.uploads == nil {
+		c.uploads = map[string]*upload{}
+	}
+	c.uploads[sessionID] = &upload{
+		conn:    c.WebsocketConnection,
+		request: request,
+	}
+	metrics.GetGauge(MetricFileTransfers, "direction", directionUpload).Inc()
+	log.Debugf("[%s] receiving the file %s", c.MACAddress, *request.Path)
+	c.reply(msg, ws.ProtoTypeFileTransfer, wsft.MessageTypeACK, nil, nil)
+}
+
+// receiveChunk acknowledges the chunk of the file being uploaded; the
+// content is discarded, only the size of the file is kept.
+func (c *Client) receiveChunk(msg *ws.ProtoMsg) {
+	sessionID := msg.Header.SessionID
+	u := c.uploads[sessionID]
+	if u == nil {
+		c.fileTransferError(msg, "no file transfer in progress")
+		return
+	}
+	offset := intProperty(msg, propertyOffset, int(u.received))
+	if int64(offset) != u.received {
+		c.endUpload(sessionID, transferFailure)
+		c.fileTransferError(msg, "unexpected chunk offset")
+		return
+	}
+	if len(msg.Body) > 0 {
+		u.received += int64(len(msg.Body))
+		metrics.GetCounter(MetricFileTransferredSize, "direction", directionUpload).Add(
+			int64(len(msg.Body)))
+		c.reply(msg, ws.ProtoTypeFileTransfer, wsft.MessageTypeACK,
+			map[string]interface{}{propertyOffset: u.received}, nil)
+		return
+	}
+
+	mode := os.FileMode(defaultFileMode)
+	if u.request.Mode != nil {
+		mode = os.FileMode(*u.request.Mode)
+	}
+	var uid, gid uint32
+	if u.request.UID != nil {
+		uid = *u.request.UID
+	}
+	if u.request.GID != nil {
+		gid = *u.request.GID
+	}
+	c.files.Create(*u.request.Path, u.received, mode, uid, gid)
+	c.endUpload(sessionID, transferSuccess)
+	c.reply(msg, ws.ProtoTypeFileTransfer, wsft.MessageTypeACK,
+		map[string]interface{}{propertyOffset: u.received}, nil)
+}
+
+func (c *Client) endUpload(sessionID string, result string) {
+	if _, ok := c.uploads[sessionID]; !ok {
+		return
+	}
+	delete(c.uploads, sessionID)
+	metrics.GetGauge(MetricFileTransfers, "direction", directionUpload).Dec()
+	metrics.GetCounter(MetricFileTransfersTotal, "direction", directionUpload,
+		"result", result).Inc()
+}
+
+func (c *Client) abortFileTransfers(sessionID string) {
+	if d := c.downloads[sessionID]; d != nil {
+		d.cancel()
+		delete(c.downloads, sessionID)
+	}
+	c.endUpload(sessionID, transferFailure)
+}
+
+// pruneFileTransfers forgets the completed downloads, and the transfers of
+// the previous websocket connections.
+func (c *Client) pruneFileTransfers() {
+	for id, d := range c.downloads {
+		select {
+		case <-d.done:
+			delete(c.downloads, id)
+			continue
+		default:
+		}
+		if d.conn != c.WebsocketConnection {
+			c.abortFileTransfers(id)
+		}
+	}
+	for id, u := range c.uploads {
+		if u.conn != c.WebsocketConnection {
+			c.abortFileTransfers(id)
+		}
+	}
+}
+
+func (c *Client) closeFileTransfers() {
+	for id := range c.downloads {
+		c.abortFileTransfers(id)
+	}
+	for id := range c.uploads {
+		c.abortFileTransfers(id)
+	}
+}
+
+func (c *Client) fileTransferError(msg *ws.ProtoMsg, message string) {
+	body, _ := msgpack.Marshal(&wsft.Error{
+		Error:       &message,
+		MessageType: &msg.Header.MsgType,
+	})
+	c.reply(msg, ws.ProtoTypeFileTransfer, wsft.MessageTypeError, nil, body)
+}
@@ -0,0 +1,300 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/distribution"
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+const urlDeviceMonitorAlert = "/api/devices/v1/devicemonitor/alert"
+
+const operationMonitorAlert = "monitor-alert"
+
+// metrics of the monitor add-on
+const (
+	// MetricMonitorAlerts counts the alerts sent by level.
+	MetricMonitorAlerts = "monitor_alerts_total"
+	// MetricMonitorAlertsDropped counts the alerts never sent because too
+	// many were pending.
+	MetricMonitorAlertsDropped = "monitor_alerts_dropped_total"
+)
+
+// types of the monitored subjects
+const (
+	MonitorTypeSystemd = "systemd"
+	MonitorTypeLog     = "log"
+)
+
+const (
+	// number of CRITICAL/OK pairs of a flapping service
+	monitorFlapCycles = 5
+	// wait between the alerts of a flapping service
+	monitorFlapInterval = 2 * time.Second
+	// wait before sending the alerts again after a failure
+	monitorRetryInterval = 30 * time.Second
+	// alerts kept when they can't be sent, the oldest ones being dropped
+	monitorMaxPendingAlerts = 100
+)
+
+// DefaultMonitorServices are the services monitored when none is configured.
+var DefaultMonitorServices = []*model.MonitorService{
+	{Name: "mender-connect", Type: MonitorTypeSystemd},
+	{Name: "sshd", Type: MonitorTypeSystemd},
+	{Name: "oom-killer", Type: MonitorTypeLog},
+}
+
+// the failures and the recoveries are Poisson arrivals
+var monitorDistribution = &distribution.Distribution{Kind: distribution.KindExponential}
+
+// ParseMonitorService parses a monitored service: <name>[:<type>], where the
+// type is systemd, the default, or log.
+func ParseMonitorService(spec string) (*model.MonitorService, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	service := &model.MonitorService{Name: parts[0], Type: MonitorTypeSystemd}
+	if len(parts) == 2 {
+		service.Type = parts[1]
+	}
+	if service.Name == "" {
+		return nil, errors.Errorf("invalid monitored service: %s", spec)
+	}
+	switch service.Type {
+	case MonitorTypeSystemd, MonitorTypeLog:
+	default:
+		return nil, errors.Errorf("invalid monitored service type: %s", spec)
+	}
+	return service, nil
+}
+
+// serviceMonitor is the state of a monitored service.
+type serviceMonitor struct {
+	service *model.MonitorService
+	failing bool
+	// flaps is the number of alerts left in the flapping episode
+	flaps int
+	// next is the time of the next alert, zero if there is none
+	next time.Time
+}
+
+// startMonitor sends the alerts of the monitored services in the background;
+// the returned function stops it and waits for the goroutine to return.
+func (c *Client) startMonitor(ctx context.Context) func() {
+	if !c.Config.Monitor || len(c.Config.MonitorServices) == 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.monitor(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// monitor sends the alerts until the context is canceled or the token is
+// rejected, in which case the device authenticates again and sends the
+// rejected alerts first. The alerts due at the same time are sent in one
+// request; the ones which fail to be sent are retried.
+func (c *Client) monitor(ctx context.Context) {
+	now := time.Now()
+	if c.monitors == nil {
+		for _, service := range c.Config.MonitorServices {
+			c.monitors = append(c.monitors,
+				&serviceMonitor{service: service, next: c.nextFailure(now)})
+		}
+	}
+	nextStorm := c.nextStorm(now)
+	for {
+		retry, err := c.flushAlerts(ctx)
+		if err == ErrUnauthorized {
+			c.Reauthenticate()
+			return
+		}
+
+		next := c.nextMonitorEvent(nextStorm)
+		if !retry.IsZero() && (next.IsZero() || retry.Before(next)) {
+			next = retry
+		}
+		if next.IsZero() || sleep(ctx, time.Until(next)) != nil {
+			return
+		}
+
+		now = time.Now()
+		storm := !nextStorm.IsZero() && !now.Before(nextStorm)
+		if storm {
+			// all the services fail at once, without flapping
+			for _, m := range c.monitors {
+				if !m.failing {
+					m.next = now
+				}
+				m.flaps = 0
+			}
+			nextStorm = c.nextStorm(now)
+			log.Debugf("[%s] %-40s", c.MACAddress, "alert storm")
+		}
+		for _, m := range c.monitors {
+			if m.next.IsZero() || now.Before(m.next) {
+				continue
+			}
+			c.alerts = append(c.alerts, c.nextAlert(m, now, storm))
+		}
+	}
+}
+
+// flushAlerts sends the pending alerts, and keeps them if that fails, up to
+// monitorMaxPendingAlerts; it returns the time to send them again, zero if
+// they were sent.
+func (c *Client) flushAlerts(ctx context.Context) (time.Time, error) {
+	if len(c.alerts) == 0 {
+		return time.Time{}, nil
+	}
+	err := c.SendAlerts(ctx, c.alerts)
+	if err == nil {
+		c.alerts = nil
+		return time.Time{}, nil
+	} else if err == ErrUnauthorized || ctx.Err() != nil {
+		return time.Time{}, err
+	}
+	if dropped := len(c.alerts) - monitorMaxPendingAlerts; dropped > 0 {
+		log.Warnf("[%s] dropping %d alerts which could not be sent", c.MACAddress,
+			dropped)
+		metrics.GetCounter(MetricMonitorAlertsDropped).Add(int64(dropped))
+		c.alerts = c.alerts[dropped:]
+	}
+	return time.Now().Add(monitorRetryInterval), nil
+}
+
+// nextMonitorEvent returns the time of the next alert or storm, or zero if
+// there is none.
+func (c *Client) nextMonitorEvent(nextStorm time.Time) time.Time {
+	next := nextStorm
+	for _, m := range c.monitors {
+		if !m.next.IsZero() && (next.IsZero() || m.next.Before(next)) {
+			next = m.next
+		}
+	}
+	return next
+}
+
+// nextAlert toggles the state of the service, schedules its next alert, and
+// returns the alert of the new state. A failure starts a flapping episode
+// with the flapping probability, unless it is part of a storm.
+func (c *Client) nextAlert(m *serviceMonitor, now time.Time, storm bool) *model.Alert {
+	m.failing = !m.failing
+	if m.failing && m.flaps == 0 && !storm &&
+		mathrand.Float64() < c.Config.MonitorFlappingProbability {
+		m.flaps = 2 * monitorFlapCycles
+	}
+	if m.flaps > 0 {
+		m.flaps--
+	}
+	switch {
+	case m.flaps > 0:
+		m.next = now.Add(monitorFlapInterval)
+	case m.failing:
+		m.next = now.Add(monitorDistribution.Sample(c.Config.MonitorRecoveryTime))
+	default:
+		m.next = c.nextFailure(now)
+	}
+
+	level, status := model.AlertLevelOK, "running"
+	if m.failing {
+		level, status = model.AlertLevelCritical, "not-running"
+	}
+	if m.service.Type == MonitorTypeLog {
+		status = "not-matched"
+		if m.failing {
+			status = "matched"
+		}
+	}
+	return &model.Alert{
+		Name:  m.service.Name,
+		Level: level,
+		Subject: model.AlertSubject{
+			Name:   m.service.Name,
+			Type:   m.service.Type,
+			Status: status,
+		},
+		Timestamp: now.UTC(),
+	}
+}
+
+// nextFailure returns the time of the next failure of a service, or zero if
+// the services only fail in the storms.
+func (c *Client) nextFailure(now time.Time) time.Time {
+	if c.Config.MonitorAlertInterval <= 0 {
+		return time.Time{}
+	}
+	return now.Add(monitorDistribution.Sample(c.Config.MonitorAlertInterval))
+}
+
+// nextStorm returns the time of the next alert storm, or zero if there is
+// none. The storms are aligned on the wall clock, for all the devices to
+// fail at once.
+func (c *Client) nextStorm(now time.Time) time.Time {
+	if c.Config.MonitorStormInterval <= 0 {
+		return time.Time{}
+	}
+	return now.Truncate(c.Config.MonitorStormInterval).Add(c.Config.MonitorStormInterval)
+}
+
+// SendAlerts sends the alerts of the monitored services.
+func (c *Client) SendAlerts(ctx context.Context, alerts []*model.Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, urlDeviceMonitorAlert, body)
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+
+	response, err := c.do(req, operationMonitorAlert, operationMonitorAlert)
+	if err != nil {
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	} else if response.StatusCode >= http.StatusMultipleChoices {
+		err = errors.Errorf("%s: unexpected status code %d", operationMonitorAlert,
+			response.StatusCode)
+		log.Errorf("[%s] %s", c.MACAddress, err)
+		return err
+	}
+	for _, alert := range alerts {
+		metrics.GetCounter(MetricMonitorAlerts, "level", alert.Level).Inc()
+	}
+	return nil
+}
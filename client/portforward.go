@@ -0,0 +1,479 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wspf "github.com/mendersoftware/go-lib-micro/ws/portforward"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack/v5"
+
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+	"github.com/mendersoftware/mender-stress-test-client/websocket"
+)
+
+// metrics of the port forwarding
+const (
+	MetricPortForwardConnections      = "port_forward_connections"
+	MetricPortForwardConnectionsTotal = "port_forward_connections_total"
+	MetricPortForwardBytes            = "port_forward_bytes_total"
+	MetricPortForwardDuration         = "port_forward_connection_seconds"
+	MetricPortForwardSessionDuration  = "port_forward_session_seconds"
+)
+
+// the built-in targets of the forwarded connections
+const (
+	PortForwardEcho = "echo"
+	PortForwardHTTP = "http"
+)
+
+// results of the port forwarding requests, as counted by
+// MetricPortForwardConnectionsTotal
+const (
+	forwardOpened   = "opened"
+	forwardRejected = "rejected"
+)
+
+// directions of the forwarded bytes, from the device's point of view
+const (
+	directionSent     = "sent"
+	directionReceived = "received"
+)
+
+const (
+	forwardBufferSize = 4096
+	// number of messages sent without being acknowledged
+	forwardWindowSize  = 8
+	forwardAckTimeout  = time.Minute
+	forwardDialTimeout = 5 * time.Second
+)
+
+// DefaultPortForwardTargets answer HTTP on the usual web ports, and echo the
+// data on the other ports.
+var DefaultPortForwardTargets = map[int]string{
+	0:    PortForwardEcho,
+	80:   PortForwardHTTP,
+	8080: PortForwardHTTP,
+}
+
+// ParsePortForwardTarget parses the target of the connections forwarded to
+// a port: <port>:<target>, where the port can be * for all the other ports,
+// and the target is echo, http or the <host>:<port> of a local server. It
+// returns the port, 0 for all the other ports, and the target.
+func ParsePortForwardTarget(spec string) (int, string, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return 0, "", errors.Errorf("invalid port forward target: %s", spec)
+	}
+	port := 0
+	if parts[0] != "*" {
+		var err error
+		port, err = strconv.Atoi(parts[0])
+		if err != nil || port < 1 || port > 65535 {
+			return 0, "", errors.Errorf("invalid port: %s", spec)
+		}
+	}
+	target := parts[1]
+	if target != PortForwardEcho && target != PortForwardHTTP {
+		_, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return 0, "", errors.Wrapf(err, "invalid target: %s", spec)
+		}
+	}
+	return port, target, nil
+}
+
+// forwardSession accounts for the traffic of the connections of a port
+// forwarding session.
+type forwardSession struct {
+	ws          *websocket.Connection
+	started     time.Time
+	connections int
+	sent        int64
+	received    int64
+}
+
+// forwardedConn relays a connection between the server and the target.
+type forwardedConn struct {
+	id        string
+	sessionID string
+	session   *forwardSession
+	remote    string
+	ws        *websocket.Connection
+	conn      net.Conn
+	// writes queues the data from the server to the target
+	writes   chan []byte
+	acks     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	started  time.Time
+	sent     int64
+	received int64
+}
+
+func (c *Client) handlePortForwardMessage(msg *ws.ProtoMsg) {
+	c.prunePortForwards()
+	id, _ := msg.Header.Properties[wspf.PropertyConnectionID].(string)
+	f := c.forwards[id]
+	switch msg.Header.MsgType {
+	case wspf.MessageTypePortForwardNew:
+		c.openPortForward(msg, id)
+	case wspf.MessageTypePortForward:
+		if f == nil {
+			c.portForwardError(msg, "connection not found")
+			return
+		}
+		select {
+		case f.writes <- msg.Body:
+		default:
+			c.portForwardError(msg, "too many unacknowledged messages")
+			f.close()
+		}
+	case wspf.MessageTypePortForwardAck:
+		if f != nil {
+			select {
+			case f.acks <- struct{}{}:
+			default:
+			}
+		}
+	case wspf.MessageTypePortForwardStop:
+		if f == nil {
+			c.portForwardError(msg, "connection not found")
+			return
+		}
+		f.close()
+		c.reply(msg, ws.ProtoTypePortForward, wspf.MessageTypePortForwardStop,
+			msg.Header.Properties, nil)
+	case wspf.MessageTypeError:
+		if f != nil {
+			f.close()
+		}
+	default:
+		c.portForwardError(msg, "unknown message type")
+	}
+}
+
+func (c *Client) openPortForward(msg *ws.ProtoMsg, id string) {
+	request := &wspf.PortForwardNew{}
+	err := msgpack.Unmarshal(msg.Body, request)
+	if err != nil || id == "" || request.RemotePort == nil {
+		c.rejectPortForward(msg, "invalid port forward request")
+		return
+	} else if c.forwards[id] != nil {
+		c.rejectPortForward(msg, "connection already exists")
+		return
+	} else if request.Protocol != nil && *request.Protocol != wspf.PortForwardProtocolTCP {
+		c.rejectPortForward(msg, "only TCP is supported")
+		return
+	}
+	remote := fmt.Sprintf("%s:%d", stringValue(request.RemoteHost), *request.RemotePort)
+	conn, err := c.dialPortForward(int(*request.RemotePort))
+	if err != nil {
+		c.rejectPortForward(msg, fmt.Sprintf("dial %s: %s", remote, err))
+		return
+	}
+	f := &forwardedConn{
+		id:        id,
+		sessionID: msg.Header.SessionID,
+		session:   c.forwardSession(msg.Header.SessionID),
+		remote:    remote,
+		ws:        c.WebsocketConnection,
+		conn:      conn,
+		writes:    make(chan []byte, forwardWindowSize),
+		acks:      make(chan struct{}, forwardWindowSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		started:   time.Now(),
+	}
+	if c.forwards == nil {
+		c.forwards = map[string]*forwardedConn{}
+	}
+	c.forwards[id] = f
+	f.session.connections++
+	metrics.GetCounter(MetricPortForwardConnectionsTotal, "result", forwardOpened).Inc()
+	metrics.GetGauge(MetricPortForwardConnections).Inc()
+	log.Debugf("[%s] port forward %s to %s opened", c.MACAddress, id, remote)
+
+	c.reply(msg, ws.ProtoTypePortForward, wspf.MessageTypePortForwardNew,
+		msg.Header.Properties, nil)
+	go f.write()
+	go c.relay(f)
+}
+
+// dialPortForward connects to the target of the port.
+func (c *Client) dialPortForward(port int) (net.Conn, error) {
+	target, ok := c.Config.PortForwardTargets[port]
+	if !ok {
+		target, ok = c.Config.PortForwardTargets[0]
+	}
+	switch {
+	case !ok:
+		return nil, errors.New("connection refused")
+	case target == PortForwardEcho:
+		local, remote := net.Pipe()
+		go echo(remote)
+		return local, nil
+	case target == PortForwardHTTP:
+		local, remote := net.Pipe()
+		go c.serveHTTP(remote)
+		return local, nil
+	}
+	return net.DialTimeout("tcp", target, forwardDialTimeout)
+}
+
+func (c *Client) rejectPortForward(msg *ws.ProtoMsg, message string) {
+	metrics.GetCounter(MetricPortForwardConnectionsTotal, "result", forwardRejected).Inc()
+	c.portForwardError(msg, message)
+}
+
+// relay sends the data from the target to the server, waiting for the server
+// to acknowledge it when too many messages are in flight; it owns the
+// connection, and ends it when the target closes it.
+func (c *Client) relay(f *forwardedConn) {
+	defer close(f.done)
+	defer f.close()
+	defer c.reportPortForward(f)
+
+	sent := metrics.GetCounter(MetricPortForwardBytes, "direction", directionSent)
+	buf := make([]byte, forwardBufferSize)
+	inFlight := 0
+	for {
+		n, err := f.conn.Read(buf)
+		if n > 0 {
+			for inFlight >= forwardWindowSize {
+				select {
+				case <-f.acks:
+					inFlight--
+				case <-f.stop:
+					return
+				case <-time.After(forwardAckTimeout):
+					log.Errorf("[%s] port forward %s: timeout waiting "+
+						"for the ack", c.MACAddress, f.id)
+					return
+				}
+			}
+			if f.send(wspf.MessageTypePortForward, buf[:n]) != nil {
+				return
+			}
+			inFlight++
+			sent.Add(int64(n))
+			atomic.AddInt64(&f.sent, int64(n))
+			atomic.AddInt64(&f.session.sent, int64(n))
+		}
+		if err != nil {
+			select {
+			case <-f.stop:
+			default:
+				// the target closed the connection
+				_ = f.send(wspf.MessageTypePortForwardStop, nil)
+			}
+			return
+		}
+	}
+}
+
+// write writes the data from the server to the target, acknowledging each
+// message once written.
+func (f *forwardedConn) write() {
+	received := metrics.GetCounter(MetricPortForwardBytes, "direction", directionReceived)
+	for {
+		select {
+		case data := <-f.writes:
+			_, err := f.conn.Write(data)
+			if err != nil {
+				// the relay stops the connection
+				return
+			}
+			received.Add(int64(len(data)))
+			atomic.AddInt64(&f.received, int64(len(data)))
+			atomic.AddInt64(&f.session.received, int64(len(data)))
+			if f.send(wspf.MessageTypePortForwardAck, nil) != nil {
+				return
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+func (f *forwardedConn) send(msgType string, body []byte) error {
+	return f.ws.WriteMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:      ws.ProtoTypePortForward,
+			MsgType:    msgType,
+			SessionID:  f.sessionID,
+			Properties: map[string]interface{}{wspf.PropertyConnectionID: f.id},
+		},
+		Body: body,
+	})
+}
+
+func (f *forwardedConn) close() {
+	f.stopOnce.Do(func() {
+		close(f.stop)
+		_ = f.conn.Close()
+	})
+}
+
+// reportPortForward accounts for the end of the connection, and logs its
+// throughput.
+func (c *Client) reportPortForward(f *forwardedConn) {
+	elapsed := time.Since(f.started)
+	metrics.GetGauge(MetricPortForwardConnections).Dec()
+	metrics.GetHistogram(MetricPortForwardDuration).Observe(elapsed)
+	sent, received := atomic.LoadInt64(&f.sent), atomic.LoadInt64(&f.received)
+	log.Debugf("[%s] port forward %s to %s closed after %s: %d bytes sent, "+
+		"%d bytes received, %.1f KiB/s", c.MACAddress, f.id, f.remote,
+		elapsed.Round(time.Millisecond), sent, received,
+		float64(sent+received)/1024/elapsed.Seconds())
+}
+
+// forwardSession returns the session with the given ID, starting it if
+// needed.
+func (c *Client) forwardSession(id string) *forwardSession {
+	s := c.forwardSessions[id]
+	if s == nil {
+		s = &forwardSession{
+			ws:      c.WebsocketConnection,
+			started: time.Now(),
+		}
+		if c.forwardSessions == nil {
+			c.forwardSessions = map[string]*forwardSession{}
+		}
+		c.forwardSessions[id] = s
+	}
+	return s
+}
+
+// endForwardSession reports the throughput of the session.
+func (c *Client) endForwardSession(id string) {
+	s := c.forwardSessions[id]
+	if s == nil {
+		return
+	}
+	delete(c.forwardSessions, id)
+	elapsed := time.Since(s.started)
+	metrics.GetHistogram(MetricPortForwardSessionDuration).Observe(elapsed)
+	sent, received := atomic.LoadInt64(&s.sent), atomic.LoadInt64(&s.received)
+	log.Infof("[%s] port forward session %s closed after %s: %d connections, "+
+		"%d bytes sent, %d bytes received, %.1f KiB/s", c.MACAddress, id,
+		elapsed.Round(time.Millisecond), s.connections, sent, received,
+		float64(sent+received)/1024/elapsed.Seconds())
+}
+
+// prunePortForwards forgets the finished connections, and closes the ones of
+// the previous websocket connections.
+func (c *Client) prunePortForwards() {
+	for id, f := range c.forwards {
+		select {
+		case <-f.done:
+			delete(c.forwards, id)
+			continue
+		default:
+		}
+		if f.ws != c.WebsocketConnection {
+			f.close()
+		}
+	}
+	for id, s := range c.forwardSessions {
+		if s.ws != c.WebsocketConnection {
+			c.endForwardSession(id)
+		}
+	}
+}
+
+// closePortForwards closes the connections of the session, or all of them
+// if the session is empty, and ends the sessions.
+func (c *Client) closePortForwards(sessionID string) {
+	for _, f := range c.forwards {
+		if sessionID == "" || f.sessionID == sessionID {
+			f.close()
+		}
+	}
+	for id := range c.forwardSessions {
+		if sessionID == "" || id == sessionID {
+			c.endForwardSession(id)
+		}
+	}
+}
+
+func (c *Client) portForwardError(msg *ws.ProtoMsg, message string) {
+	body, _ := msgpack.Marshal(&wspf.Error{
+		Error:       &message,
+		MessageType: &msg.Header.MsgType,
+	})
+	c.reply(msg, ws.ProtoTypePortForward, wspf.MessageTypeError,
+		msg.Header.Properties, body)
+}
+
+// echo sends the data back until the connection is closed.
+func echo(conn net.Conn) {
+	defer conn.Close()
+	_, _ = io.Copy(conn, conn)
+}
+
+// serveHTTP answers the HTTP requests with a short description of the
+// device and of the request.
+func (c *Client) serveHTTP(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, request.Body)
+		body := fmt.Sprintf("%s: %s %s\n", c.hostname(), request.Method, request.URL)
+		response := &http.Response{
+			StatusCode:    http.StatusOK,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Request:       request,
+			Header:        http.Header{"Content-Type": {"text/plain"}},
+			ContentLength: int64(len(body)),
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			Close:         request.Close,
+		}
+		err = response.Write(writer)
+		if err == nil {
+			err = writer.Flush()
+		}
+		if err != nil || request.Close {
+			return
+		}
+	}
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/mendersoftware/mender-stress-test-client/distribution"
+)
+
+// websocket reconnect strategies
+const (
+	// ReconnectFixed waits the reconnect interval before each attempt
+	ReconnectFixed = "fixed"
+	// ReconnectExponential doubles the wait after each failed attempt, up
+	// to the maximum interval, with a random jitter of up to half of it
+	ReconnectExponential = "exponential"
+	// ReconnectImmediate reconnects right after a disconnection, and waits
+	// the reconnect interval after a failed attempt
+	ReconnectImmediate = "immediate"
+)
+
+// websocket metric labels
+const (
+	reconnectSuccess = "success"
+	reconnectFailure = "failure"
+	disconnectForced = "forced"
+	disconnectClosed = "closed"
+)
+
+// the forced disconnections are Poisson arrivals
+var disconnectDistribution = &distribution.Distribution{Kind: distribution.KindExponential}
+
+// reconnectDelay returns the wait before the given reconnect attempt,
+// counted from zero since the last disconnection.
+func (c *Client) reconnectDelay(attempt int) time.Duration {
+	interval := c.Config.WebsocketReconnectInterval
+	switch c.Config.WebsocketReconnect {
+	case ReconnectImmediate:
+		if attempt == 0 {
+			return 0
+		}
+	case ReconnectExponential:
+		max := c.Config.WebsocketReconnectMaxInterval
+		for i := 0; i < attempt && interval < max; i++ {
+			interval *= 2
+		}
+		if interval > max {
+			interval = max
+		}
+		if interval > 1 {
+			interval = interval/2 + time.Duration(rand.Int63n(int64(interval/2)))
+		}
+	}
+	return interval
+}
+
+// disconnectAfter returns the time after which the websocket is forcibly
+// closed, or zero if it is never.
+func (c *Client) disconnectAfter() time.Duration {
+	return disconnectDistribution.Sample(c.Config.WebsocketDisconnectInterval)
+}
@@ -0,0 +1,140 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+)
+
+// operation names of the requests, as reported in the logs and metrics
+const (
+	OperationAuthentication = "authentication"
+	OperationSendInventory  = "send-inventory"
+	OperationUpdateCheck    = "update-check"
+)
+
+const (
+	operationDeploymentStatus = "deployment-status"
+	operationDeploymentLog    = "deployment-log"
+)
+
+// error classes of the requests, as reported in the logs and metrics
+const (
+	ErrorClassTimeout  = "timeout"
+	ErrorClassCanceled = "canceled"
+	ErrorClassNetwork  = "network"
+)
+
+// metrics of the devices
+const (
+	MetricRequests        = "requests_total"
+	MetricRequestDuration = "request_duration_seconds"
+	MetricDeviceState     = "device_state"
+	MetricWebsockets      = "websockets_connected"
+	MetricDeployments     = "deployments_total"
+
+	MetricWebsocketDisconnects   = "websocket_disconnects_total"
+	MetricWebsocketReconnects    = "websocket_reconnects_total"
+	MetricWebsocketReconnectTime = "websocket_reconnect_seconds"
+)
+
+// RequestError is returned when a request fails without a response.
+type RequestError struct {
+	Operation string
+	Class     string
+	Err       error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Operation, e.Class, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+func (c *Client) newRequest(ctx context.Context, method string, url string,
+	body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.Config.ServerURL+url,
+		bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	if c.JWTToken != "" {
+		req.Header.Add("Authorization", "Bearer "+c.JWTToken)
+	}
+	return req, nil
+}
+
+// do sends the request, logging and recording the outcome of the operation.
+func (c *Client) do(req *http.Request, operation string, label string) (*http.Response, error) {
+	start := time.Now()
+	response, err := c.HTTPClient.Do(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		class := errorClass(err)
+		metrics.GetCounter(MetricRequests, "operation", operation, "class", class).Inc()
+		return nil, &RequestError{
+			Operation: label,
+			Class:     class,
+			Err:       err,
+		}
+	}
+	class := fmt.Sprintf("%dxx", response.StatusCode/100)
+	metrics.GetCounter(MetricRequests, "operation", operation, "class", class).Inc()
+	metrics.GetHistogram(MetricRequestDuration, "operation", operation).Observe(elapsed)
+
+	log.Debugf("[%s] %-40s %d (%6d ms)", c.MACAddress, label,
+		response.StatusCode, elapsed.Milliseconds())
+	if hook, ok := req.Context().Value(responseHookKey{}).(func(string)); ok {
+		hook(operation)
+	}
+	return response, nil
+}
+
+func errorClass(err error) string {
+	var netErr net.Error
+	if errors.Is(err, context.Canceled) {
+		return ErrorClassCanceled
+	} else if errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &netErr) && netErr.Timeout()) {
+		return ErrorClassTimeout
+	}
+	return ErrorClassNetwork
+}
+
+// sleep waits for the given duration, returning early with an error if the
+// context is canceled.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"time"
+
+	"github.com/mendersoftware/mender-stress-test-client/distribution"
+)
+
+// schedule computes when a periodic poll fires next.
+type schedule struct {
+	interval     func() time.Duration
+	distribution *distribution.Distribution
+	// lockstep aligns the polls to the wall-clock multiples of the
+	// interval, shifted by offset, so that all the devices poll together
+	lockstep bool
+	offset   time.Duration
+}
+
+func (c *Client) newSchedule(interval func() time.Duration,
+	distribution *distribution.Distribution) *schedule {
+	return &schedule{
+		interval:     interval,
+		distribution: distribution,
+		lockstep:     c.Config.Lockstep,
+		offset:       c.ClockSkew,
+	}
+}
+
+// next returns the time to wait from now until the next poll.
+func (s *schedule) next(now time.Time) time.Duration {
+	interval := s.interval()
+	if !s.lockstep || interval <= 0 {
+		return s.distribution.Sample(interval)
+	}
+	boundary := now.Add(-s.offset).Truncate(interval).Add(interval)
+	return boundary.Add(s.offset).Sub(now)
+}
+
+func (c *Client) inventoryInterval() time.Duration {
+	return c.Config.Settings.Get().InventoryInterval
+}
+
+func (c *Client) updateInterval() time.Duration {
+	return c.Config.Settings.Get().UpdateInterval
+}
+
+func (c *Client) authRetryInterval() time.Duration {
+	return c.Config.AuthIntervalDistribution.Sample(c.Config.Settings.Get().AuthInterval)
+}
+
+func (c *Client) deploymentStepTime() time.Duration {
+	return c.Config.DeploymentTimeDistribution.Sample(
+		c.Config.Settings.Get().DeploymentTime)
+}
+
+// resetTimer stops the timer, draining its channel if it already fired, and
+// starts it again with the given duration.
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(d)
+}
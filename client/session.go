@@ -0,0 +1,91 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"github.com/mendersoftware/go-lib-micro/ws"
+	log "github.com/sirupsen/logrus"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// the protocols the emulated devices accept in the session handshake
+var supportedProtocols = []ws.ProtoType{
+	ws.ProtoTypeShell,
+	ws.ProtoTypeFileTransfer,
+	ws.ProtoTypePortForward,
+	ws.ProtoTypeMenderClient,
+}
+
+// handleControlMessage answers the session control messages: the handshake
+// opening a session, and the pings.
+func (c *Client) handleControlMessage(msg *ws.ProtoMsg) {
+	switch msg.Header.MsgType {
+	case ws.MessageTypeOpen:
+		open := &ws.Open{}
+		err := msgpack.Unmarshal(msg.Body, open)
+		if err != nil {
+			c.sendError(msg, "invalid open message", true)
+			return
+		}
+		supported := false
+		for _, version := range open.Versions {
+			supported = supported || version == ws.ProtocolVersion
+		}
+		if !supported {
+			c.sendError(msg, "unsupported protocol version", true)
+			return
+		}
+		body, _ := msgpack.Marshal(&ws.Accept{
+			Version:   ws.ProtocolVersion,
+			Protocols: supportedProtocols,
+		})
+		c.reply(msg, ws.ProtoTypeControl, ws.MessageTypeAccept, nil, body)
+	case ws.MessageTypePing:
+		c.reply(msg, ws.ProtoTypeControl, ws.MessageTypePong, nil, nil)
+	case ws.MessageTypeClose:
+		c.closeShell(msg.Header.SessionID)
+		c.abortFileTransfers(msg.Header.SessionID)
+		c.closePortForwards(msg.Header.SessionID)
+	}
+}
+
+// reply sends a message on the session of the given message.
+func (c *Client) reply(msg *ws.ProtoMsg, proto ws.ProtoType, msgType string,
+	properties map[string]interface{}, body []byte) {
+	err := c.WebsocketConnection.WriteMessage(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:      proto,
+			MsgType:    msgType,
+			SessionID:  msg.Header.SessionID,
+			Properties: properties,
+		},
+		Body: body,
+	})
+	if err != nil {
+		log.Debugf("[%s] websocket write: %s", c.MACAddress, err)
+	}
+}
+
+// sendError answers the message with an error, which closes the session if
+// requested.
+func (c *Client) sendError(msg *ws.ProtoMsg, message string, close bool) {
+	body, _ := msgpack.Marshal(ws.Error{
+		Error:        message,
+		MessageProto: msg.Header.Proto,
+		MessageType:  msg.Header.MsgType,
+		Close:        close,
+	})
+	c.reply(msg, ws.ProtoTypeControl, ws.MessageTypeError, nil, body)
+}
@@ -0,0 +1,297 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+	"github.com/mendersoftware/mender-stress-test-client/websocket"
+)
+
+// metrics of the remote terminal sessions
+const (
+	MetricShellSessions       = "shell_sessions"
+	MetricShellSessionsTotal  = "shell_sessions_total"
+	MetricShellMessageLatency = "shell_message_seconds"
+)
+
+// results of the shell spawn requests, as counted by MetricShellSessionsTotal
+const (
+	shellStarted  = "started"
+	shellRejected = "rejected"
+)
+
+const (
+	shellPrompt = "$ "
+
+	propertyStatus         = "status"
+	propertyUserID         = "user_id"
+	propertyTerminalWidth  = "terminal_width"
+	propertyTerminalHeight = "terminal_height"
+)
+
+// shellSession is a fake shell: it echoes the input and answers the
+// commands from the script, or with a few built-in ones.
+type shellSession struct {
+	id     string
+	userID string
+	// conn is the websocket connection the session was spawned on; the
+	// session ends with the connection
+	conn   *websocket.Connection
+	width  int
+	height int
+	line   []byte
+}
+
+// LoadShellScript reads the canned answers of the fake shells: a JSON
+// object mapping the command lines to their output.
+func LoadShellScript(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	script := map[string]string{}
+	err = json.Unmarshal(data, &script)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid shell script %s", path)
+	}
+	return script, nil
+}
+
+// handleShellMessage handles the message received at the given time; the
+// latency of the input is measured from the reception, so that it includes
+// the time the message waited for the device.
+func (c *Client) handleShellMessage(msg *ws.ProtoMsg, received time.Time) {
+	c.pruneShells()
+	session := c.shells[msg.Header.SessionID]
+	switch msg.Header.MsgType {
+	case wsshell.MessageTypeSpawnShell:
+		c.spawnShell(msg)
+	case wsshell.MessageTypeShellCommand:
+		if session == nil {
+			c.shellError(msg, "session not found")
+			return
+		}
+		output, exit := session.input(c, msg.Body)
+		if len(output) > 0 {
+			c.reply(msg, ws.ProtoTypeShell, wsshell.MessageTypeShellCommand,
+				shellStatus(wsshell.NormalMessage), output)
+		}
+		metrics.GetHistogram(MetricShellMessageLatency).Observe(time.Since(received))
+		if exit {
+			c.stopShell(session)
+		}
+	case wsshell.MessageTypeResizeShell:
+		if session != nil {
+			session.width = intProperty(msg, propertyTerminalWidth, session.width)
+			session.height = intProperty(msg, propertyTerminalHeight, session.height)
+		}
+	case wsshell.MessageTypePingShell:
+		c.reply(msg, ws.ProtoTypeShell, wsshell.MessageTypePongShell,
+			shellStatus(wsshell.ControlMessage), nil)
+	case wsshell.MessageTypeStopShell:
+		if session == nil {
+			c.shellError(msg, "session not found")
+			return
+		}
+		c.stopShell(session)
+	}
+}
+
+func (c *Client) spawnShell(msg *ws.ProtoMsg) {
+	userID, _ := msg.Header.Properties[propertyUserID].(string)
+	if c.shells[msg.Header.SessionID] != nil {
+		metrics.GetCounter(MetricShellSessionsTotal, "result", shellRejected).Inc()
+		c.shellError(msg, "session already exists")
+		return
+	} else if len(c.shells) >= c.Config.ShellMaxSessions {
+		metrics.GetCounter(MetricShellSessionsTotal, "result", shellRejected).Inc()
+		c.shellError(msg, "maximum number of shell sessions reached")
+		return
+	}
+	session := &shellSession{
+		id:     msg.Header.SessionID,
+		userID: userID,
+		conn:   c.WebsocketConnection,
+		width:  intProperty(msg, propertyTerminalWidth, 80),
+		height: intProperty(msg, propertyTerminalHeight, 24),
+	}
+	if c.shells == nil {
+		c.shells = map[string]*shellSession{}
+	}
+	c.shells[session.id] = session
+	metrics.GetCounter(MetricShellSessionsTotal, "result", shellStarted).Inc()
+	metrics.GetGauge(MetricShellSessions).Inc()
+	log.Debugf("[%s] shell session %s started for %s", c.MACAddress, session.id, userID)
+
+	c.reply(msg, ws.ProtoTypeShell, wsshell.MessageTypeSpawnShell,
+		shellStatus(wsshell.NormalMessage), []byte("Shell started"))
+	c.reply(msg, ws.ProtoTypeShell, wsshell.MessageTypeShellCommand,
+		shellStatus(wsshell.NormalMessage), []byte(shellPrompt))
+}
+
+// stopShell ends the session, telling the server.
+func (c *Client) stopShell(session *shellSession) {
+	c.closeShell(session.id)
+	c.reply(&ws.ProtoMsg{Header: ws.ProtoHdr{SessionID: session.id}},
+		ws.ProtoTypeShell, wsshell.MessageTypeStopShell,
+		shellStatus(wsshell.NormalMessage), []byte("Shell stopped"))
+}
+
+// closeShell forgets the session, if it exists.
+func (c *Client) closeShell(id string) {
+	if _, ok := c.shells[id]; !ok {
+		return
+	}
+	delete(c.shells, id)
+	metrics.GetGauge(MetricShellSessions).Dec()
+	log.Debugf("[%s] shell session %s stopped", c.MACAddress, id)
+}
+
+// pruneShells forgets the sessions of the previous websocket connections.
+func (c *Client) pruneShells() {
+	for id, session := range c.shells {
+		if session.conn != c.WebsocketConnection {
+			c.closeShell(id)
+		}
+	}
+}
+
+func (c *Client) closeShells() {
+	for id := range c.shells {
+		c.closeShell(id)
+	}
+}
+
+func (c *Client) shellError(msg *ws.ProtoMsg, message string) {
+	c.reply(msg, ws.ProtoTypeShell, msg.Header.MsgType,
+		shellStatus(wsshell.ErrorMessage), []byte(message))
+}
+
+// input handles the keystrokes like a terminal in cooked mode, and returns
+// the output and whether the shell exited.
+func (s *shellSession) input(c *Client, data []byte) ([]byte, bool) {
+	var out strings.Builder
+	for _, b := range data {
+		switch {
+		case b == '\r' || b == '\n':
+			out.WriteString("\r\n")
+			line := strings.TrimSpace(string(s.line))
+			s.line = s.line[:0]
+			if line == "exit" || line == "logout" {
+				return []byte(out.String()), true
+			}
+			output := s.run(c, line)
+			if output != "" {
+				out.WriteString(strings.ReplaceAll(output, "\n", "\r\n") + "\r\n")
+			}
+			out.WriteString(shellPrompt)
+		case b == 0x7f || b == '\b':
+			if len(s.line) > 0 {
+				s.line = s.line[:len(s.line)-1]
+				out.WriteString("\b \b")
+			}
+		case b == 0x03:
+			s.line = s.line[:0]
+			out.WriteString("^C\r\n" + shellPrompt)
+		case b == 0x04 && len(s.line) == 0:
+			return []byte(out.String()), true
+		case b >= ' ':
+			s.line = append(s.line, b)
+			out.WriteByte(b)
+		}
+	}
+	return []byte(out.String()), false
+}
+
+// run returns the output of the command line.
+func (s *shellSession) run(c *Client, line string) string {
+	if output, ok := c.Config.ShellScript[line]; ok {
+		return strings.TrimRight(output, "\n")
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	switch fields[0] {
+	case "echo":
+		return strings.Join(fields[1:], " ")
+	case "hostname":
+		return c.hostname()
+	case "whoami":
+		return "root"
+	case "pwd":
+		return "/root"
+	case "ls":
+		return ""
+	case "date":
+		return time.Now().UTC().Format(time.UnixDate)
+	case "uname":
+		if len(fields) > 1 && fields[1] == "-a" {
+			return fmt.Sprintf("Linux %s 5.10.0 #1 SMP x86_64 GNU/Linux",
+				c.hostname())
+		}
+		return "Linux"
+	case "stty":
+		return fmt.Sprintf("rows %d; columns %d;", s.height, s.width)
+	}
+	return fmt.Sprintf("sh: %s: not found", fields[0])
+}
+
+func (c *Client) hostname() string {
+	return "device-" + strings.ReplaceAll(c.MACAddress, ":", "")
+}
+
+func shellStatus(status wsshell.MenderShellMessageStatus) map[string]interface{} {
+	return map[string]interface{}{
+		propertyStatus: status,
+	}
+}
+
+// intProperty returns the integer property of the message; msgpack decodes
+// the numbers to various integer types.
+func intProperty(msg *ws.ProtoMsg, name string, defaultValue int) int {
+	switch v := msg.Header.Properties[name].(type) {
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	case uint64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return defaultValue
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+)
+
+// states of a running device
+const (
+	StateAuthenticating = "authenticating"
+	StateIdle           = "idle"
+	StateDeploying      = "deploying"
+)
+
+// results of the deployments, as counted by MetricDeployments
+const (
+	DeploymentSuccess = statusSuccess
+	DeploymentFailure = statusFailure
+)
+
+// setState moves the device to the given state, keeping count of the
+// devices in each state; the empty state means the device stopped.
+func (c *Client) setState(state string) {
+	if state == c.state {
+		return
+	}
+	if c.state != "" {
+		metrics.GetGauge(MetricDeviceState, "state", c.state).Dec()
+	}
+	if state != "" {
+		metrics.GetGauge(MetricDeviceState, "state", state).Inc()
+	}
+	c.state = state
+}
@@ -0,0 +1,84 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsmc "github.com/mendersoftware/go-lib-micro/ws/menderclient"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+)
+
+// metrics of the requests triggered from the server
+const (
+	MetricTriggers        = "websocket_triggers_total"
+	MetricTriggersDropped = "websocket_triggers_dropped_total"
+	MetricTriggerLatency  = "websocket_trigger_seconds"
+)
+
+// responseHookKey is the context key of the function called by do with the
+// operation of each response.
+type responseHookKey struct{}
+
+// withResponseHook returns a context making do call the hook on each response
+// of the requests sent with it.
+func withResponseHook(ctx context.Context, hook func(operation string)) context.Context {
+	return context.WithValue(ctx, responseHookKey{}, hook)
+}
+
+// isTrigger returns true if the message is a command handled by
+// handleMenderClientMessage.
+func isTrigger(msg *ws.ProtoMsg) bool {
+	switch msg.Header.MsgType {
+	case wsmc.MessageTypeMenderClientCheckUpdate,
+		wsmc.MessageTypeMenderClientSendInventory:
+		return true
+	}
+	return false
+}
+
+// handleMenderClientMessage runs the update check or the inventory update
+// requested by the server right away, even when the polls are paused, and
+// measures the time from the reception of the trigger, including the time it
+// waited for the device to be available, to the response of the resulting
+// REST call; the deployment which may follow is not included.
+func (c *Client) handleMenderClientMessage(ctx context.Context, msg *ws.ProtoMsg,
+	received time.Time) error {
+	var operation string
+	var request func(ctx context.Context) error
+	switch msg.Header.MsgType {
+	case wsmc.MessageTypeMenderClientCheckUpdate:
+		operation, request = OperationUpdateCheck, c.UpdateCheck
+	case wsmc.MessageTypeMenderClientSendInventory:
+		operation, request = OperationSendInventory, c.SendInventory
+	default:
+		return nil
+	}
+	log.Debugf("[%s] %-40s", c.MACAddress, operation+" triggered")
+	metrics.GetCounter(MetricTriggers, "operation", operation).Inc()
+	observed := false
+	ctx = withResponseHook(ctx, func(responseOperation string) {
+		if responseOperation == operation && !observed {
+			observed = true
+			metrics.GetHistogram(MetricTriggerLatency, "operation", operation).Observe(
+				time.Since(received))
+		}
+	})
+	return request(ctx)
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+
+	"github.com/mendersoftware/mender-stress-test-client/cluster"
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+func coordinate(config *model.CoordinatorConfig) error {
+	ctx, cancel := withSignals(context.Background())
+	defer cancel()
+	return cluster.NewCoordinator(config).Run(ctx)
+}
+
+// work registers with the coordinator and runs the assigned share of the
+// clients, with the run options given by the coordinator.
+func work(runCommand *cli.Command, coordinatorURL string) error {
+	ctx, cancel := withSignals(context.Background())
+	defer cancel()
+
+	worker := cluster.NewWorker(coordinatorURL)
+	log.Infof("registering with the coordinator %s", coordinatorURL)
+	assignment, err := worker.Register(ctx)
+	if ctx.Err() != nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	config, err := parseRunArgs(runCommand, assignment.Args)
+	if err != nil {
+		return err
+	}
+	// the open model rates are shared between the workers, in proportion
+	// to their number of devices
+	share := float64(assignment.Count) / float64(assignment.TotalCount)
+	config.AuthRate *= share
+	config.InventoryRate *= share
+	config.UpdateRate *= share
+	config.ArrivalIndexOffset = config.IndexOffset + assignment.ArrivalIndexOffset
+	config.ArrivalIndexLimit = config.ArrivalIndexOffset + assignment.ArrivalIndexCount
+	config.IndexOffset += assignment.IndexOffset
+	config.Count = assignment.Count
+
+	log.Infof("%s: running the devices %d to %d", assignment.ID, config.IndexOffset,
+		config.IndexOffset+config.Count-1)
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-time.After(time.Duration(assignment.StartInMs) * time.Millisecond):
+	}
+
+	reportCtx, stopReports := context.WithCancel(context.Background())
+	go worker.RunReports(reportCtx)
+	err = run(config)
+	stopReports()
+	reportErr := worker.Report(context.Background(), true)
+	if reportErr != nil {
+		log.Warnf("sending the metrics to the coordinator: %s", reportErr)
+	}
+	return err
+}
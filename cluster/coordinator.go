@@ -0,0 +1,396 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/client"
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+type worker struct {
+	index      int
+	assignment *Assignment
+	hostname   string
+	metrics    metrics.Snapshot
+	done       bool
+}
+
+// Coordinator hands out the device ranges to the workers and aggregates
+// their metrics into a single report.
+type Coordinator struct {
+	config   *model.CoordinatorConfig
+	mutex    sync.Mutex
+	workers  []*worker
+	ready    chan struct{}
+	finished chan struct{}
+	previous metrics.Snapshot
+	last     time.Time
+}
+
+func NewCoordinator(config *model.CoordinatorConfig) *Coordinator {
+	return &Coordinator{
+		config:   config,
+		ready:    make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+// Run waits for the workers to register, then reports the aggregated
+// metrics until all the workers are done or the context is canceled.
+func (c *Coordinator) Run(ctx context.Context) error {
+	server := &http.Server{
+		Addr:    c.config.Listen,
+		Handler: c.handler(),
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	defer server.Close() //nolint:errcheck
+
+	log.Infof("waiting for %d workers on %s", c.config.Workers, c.config.Listen)
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errs:
+		return err
+	case <-c.ready:
+	}
+	log.Infof("all the workers registered, starting %d clients in %s",
+		c.config.Count, c.config.StartDelay)
+
+	c.previous = metrics.Snapshot{}
+	c.last = time.Now()
+	ticker := time.NewTicker(c.config.ReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.finalReport()
+			return nil
+		case <-c.finished:
+			log.Info("all the workers are done")
+			c.finalReport()
+			return nil
+		case err := <-errs:
+			return err
+		case <-ticker.C:
+			c.report()
+		}
+	}
+}
+
+func (c *Coordinator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(urlWorkers, c.register)
+	mux.HandleFunc(urlWorkers+"/", c.receiveReport)
+	mux.HandleFunc(urlMetrics, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = c.merged().Write(w)
+	})
+	return mux
+}
+
+// register assigns the next device range to the worker and answers once all
+// the workers registered, so that they start together.
+func (c *Coordinator) register(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	registration := &Registration{}
+	err := json.NewDecoder(r.Body).Decode(registration)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mutex.Lock()
+	if len(c.workers) == c.config.Workers {
+		c.mutex.Unlock()
+		http.Error(w, "all the workers already registered", http.StatusConflict)
+		return
+	}
+	index := c.freeIndex()
+	assignment := c.assignment(index)
+	registered := &worker{
+		index:      index,
+		assignment: assignment,
+		hostname:   registration.Hostname,
+	}
+	c.workers = append(c.workers, registered)
+	log.Infof("worker %s registered from %s (%s): devices %d to %d",
+		assignment.ID, registration.Hostname, r.RemoteAddr, assignment.IndexOffset,
+		assignment.IndexOffset+assignment.Count-1)
+	if len(c.workers) == c.config.Workers {
+		close(c.ready)
+	}
+	c.mutex.Unlock()
+
+	select {
+	case <-r.Context().Done():
+		c.abandon(registered)
+		return
+	case <-c.ready:
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(assignment)
+}
+
+// freeIndex returns the lowest index not assigned to a registered worker.
+func (c *Coordinator) freeIndex() int {
+	for index := 0; ; index++ {
+		taken := false
+		for _, worker := range c.workers {
+			taken = taken || worker.index == index
+		}
+		if !taken {
+			return index
+		}
+	}
+}
+
+// abandon forgets the worker which left before receiving its assignment, so
+// that the next worker registering takes its place; if all the workers were
+// already registered, the run goes on without it, and it counts as done.
+func (c *Coordinator) abandon(abandoned *worker) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.ready:
+		log.Warnf("worker %s left at the start, its devices won't run",
+			abandoned.assignment.ID)
+		abandoned.done = true
+		if c.countDone() == c.config.Workers {
+			close(c.finished)
+		}
+		return
+	default:
+	}
+	log.Warnf("worker %s left before the start, waiting for another one",
+		abandoned.assignment.ID)
+	for i, worker := range c.workers {
+		if worker == abandoned {
+			c.workers = append(c.workers[:i], c.workers[i+1:]...)
+			return
+		}
+	}
+}
+
+// assignment splits the devices evenly between the workers, and the indexes
+// reserved for the devices started beyond the count as well.
+func (c *Coordinator) assignment(index int) *Assignment {
+	workers := int64(c.config.Workers)
+	count := c.config.Count / workers
+	remainder := c.config.Count % workers
+	offset := int64(index) * count
+	if int64(index) < remainder {
+		count++
+		offset += int64(index)
+	} else {
+		offset += remainder
+	}
+	arrivals := c.config.ArrivalIndexes / workers
+	return &Assignment{
+		ID:                 fmt.Sprintf("worker-%d", index),
+		Args:               c.config.Args,
+		IndexOffset:        offset,
+		Count:              count,
+		TotalCount:         c.config.Count,
+		ArrivalIndexOffset: c.config.Count + int64(index)*arrivals,
+		ArrivalIndexCount:  arrivals,
+		StartInMs:          c.config.StartDelay.Milliseconds(),
+		ReportIntervalMs:   c.config.ReportInterval.Milliseconds(),
+	}
+}
+
+func (c *Coordinator) receiveReport(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, urlWorkers+"/"), "/metrics")
+	if r.Method != http.MethodPut {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := &Report{}
+	err := json.NewDecoder(r.Body).Decode(report)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, worker := range c.workers {
+		if worker.assignment.ID != id {
+			continue
+		}
+		worker.metrics = report.Metrics
+		if report.Done && !worker.done {
+			worker.done = true
+			log.Infof("worker %s is done", id)
+			if c.countDone() == c.config.Workers {
+				close(c.finished)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, "unknown worker", http.StatusNotFound)
+}
+
+func (c *Coordinator) countDone() int {
+	done := 0
+	for _, worker := range c.workers {
+		if worker.done {
+			done++
+		}
+	}
+	return done
+}
+
+func (c *Coordinator) merged() metrics.Snapshot {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	snapshots := make([]metrics.Snapshot, 0, len(c.workers))
+	for _, worker := range c.workers {
+		snapshots = append(snapshots, worker.metrics)
+	}
+	return metrics.Merge(snapshots...)
+}
+
+// report logs the state of the devices and the request rates and latencies
+// of all the workers since the previous report.
+func (c *Coordinator) report() {
+	current := c.merged()
+	now := time.Now()
+	elapsed := now.Sub(c.last).Seconds()
+	c.mutex.Lock()
+	done := c.countDone()
+	c.mutex.Unlock()
+
+	states := map[string]int64{}
+	for _, sm := range current.Find(client.MetricDeviceState) {
+		states[sm.Label("state")] = sm.Value
+	}
+	websockets := int64(0)
+	for _, sm := range current.Find(client.MetricWebsockets) {
+		websockets += sm.Value
+	}
+	log.Infof("workers %d (%d done), devices: authenticating %d, idle %d, "+
+		"deploying %d, websockets %d", c.config.Workers, done,
+		states[client.StateAuthenticating], states[client.StateIdle],
+		states[client.StateDeploying], websockets)
+
+	for _, op := range operationStats(current, c.previous) {
+		if op.requests == 0 {
+			continue
+		}
+		log.Infof("%-20s %8.1f rps, p50 %6d ms, p99 %6d ms, %s", op.operation,
+			float64(op.requests)/elapsed, op.duration.Quantile(0.5).Milliseconds(),
+			op.duration.Quantile(0.99).Milliseconds(), op.classes)
+	}
+	c.previous = current
+	c.last = now
+}
+
+// finalReport logs the totals of the whole run.
+func (c *Coordinator) finalReport() {
+	current := c.merged()
+	log.Info("final report:")
+	for _, op := range operationStats(current, metrics.Snapshot{}) {
+		log.Infof("%-20s %10d requests, p50 %6d ms, p99 %6d ms, %s", op.operation,
+			op.requests, op.duration.Quantile(0.5).Milliseconds(),
+			op.duration.Quantile(0.99).Milliseconds(), op.classes)
+	}
+	deployments := map[string]int64{}
+	for _, sm := range current.Find(client.MetricDeployments) {
+		deployments[sm.Label("result")] = sm.Value
+	}
+	log.Infof("deployments: %d succeeded, %d failed",
+		deployments[client.DeploymentSuccess], deployments[client.DeploymentFailure])
+}
+
+type operation struct {
+	operation string
+	requests  int64
+	classes   string
+	duration  metrics.HistogramSnapshot
+}
+
+// operationStats returns the requests per operation between the two
+// snapshots.
+func operationStats(current, previous metrics.Snapshot) []*operation {
+	counts := requestCounts(current)
+	previousCounts := requestCounts(previous)
+	durations := requestDurations(current)
+	previousDurations := requestDurations(previous)
+
+	ops := make([]*operation, 0, len(counts))
+	for name, classes := range counts {
+		op := &operation{
+			operation: name,
+			duration:  durations[name].Sub(previousDurations[name]),
+		}
+		parts := []string{}
+		for class, count := range classes {
+			count -= previousCounts[name][class]
+			op.requests += count
+			if count > 0 {
+				parts = append(parts, fmt.Sprintf("%s %d", class, count))
+			}
+		}
+		sort.Strings(parts)
+		op.classes = strings.Join(parts, ", ")
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].operation < ops[j].operation
+	})
+	return ops
+}
+
+// requestCounts returns the number of requests per operation and class.
+func requestCounts(snapshot metrics.Snapshot) map[string]map[string]int64 {
+	counts := map[string]map[string]int64{}
+	for _, sm := range snapshot.Find(client.MetricRequests) {
+		operation := sm.Label("operation")
+		if counts[operation] == nil {
+			counts[operation] = map[string]int64{}
+		}
+		counts[operation][sm.Label("class")] += sm.Value
+	}
+	return counts
+}
+
+func requestDurations(snapshot metrics.Snapshot) map[string]metrics.HistogramSnapshot {
+	durations := map[string]metrics.HistogramSnapshot{}
+	for _, sm := range snapshot.Find(client.MetricRequestDuration) {
+		if sm.Histogram != nil {
+			durations[sm.Label("operation")] = *sm.Histogram
+		}
+	}
+	return durations
+}
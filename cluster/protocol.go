@@ -0,0 +1,60 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package cluster distributes a run over several worker processes: the
+// workers register with a coordinator, which assigns each of them a
+// disjoint range of device indexes, starts them together and aggregates
+// their metrics.
+package cluster
+
+import (
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+)
+
+const (
+	urlWorkers       = "/api/v1/workers"
+	urlWorkerMetrics = "/api/v1/workers/{id}/metrics"
+	urlMetrics       = "/metrics"
+)
+
+// Registration is sent by a worker to join the run.
+type Registration struct {
+	Hostname string `json:"hostname"`
+}
+
+// Assignment is the share of the run given to a worker.
+type Assignment struct {
+	ID string `json:"id"`
+	// Args are the arguments of the run command, shared by all the workers
+	Args        []string `json:"args"`
+	IndexOffset int64    `json:"index_offset"`
+	Count       int64    `json:"count"`
+	TotalCount  int64    `json:"total_count"`
+	// ArrivalIndexOffset and ArrivalIndexCount are the range of indexes,
+	// after the ones of the run, reserved for the devices the worker starts
+	// beyond its count
+	ArrivalIndexOffset int64 `json:"arrival_index_offset"`
+	ArrivalIndexCount  int64 `json:"arrival_index_count"`
+	// StartInMs is the delay before starting the clients, the same for
+	// all the workers
+	StartInMs int64 `json:"start_in_ms"`
+	// ReportIntervalMs is the interval between two metrics reports
+	ReportIntervalMs int64 `json:"report_interval_ms"`
+}
+
+// Report carries the metrics of a worker.
+type Report struct {
+	Done    bool             `json:"done"`
+	Metrics metrics.Snapshot `json:"metrics"`
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cluster
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ShardNone     = "none"
+	ShardHostname = "hostname"
+	// ShardEnvPrefix is followed by the name of the environment variable
+	// holding the ordinal
+	ShardEnvPrefix = "env:"
+)
+
+// ReplicaOrdinal returns the ordinal of this replica for the given sharding
+// mode: the number after the last dash of the hostname, as given to the pods
+// of a Kubernetes StatefulSet, or the value of an environment variable.
+func ReplicaOrdinal(mode string) (int64, error) {
+	var value string
+	switch {
+	case mode == ShardNone:
+		return 0, nil
+	case mode == ShardHostname:
+		hostname, err := os.Hostname()
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to get the hostname")
+		}
+		i := strings.LastIndex(hostname, "-")
+		if i < 0 {
+			return 0, errors.Errorf("no ordinal in the hostname %s", hostname)
+		}
+		value = hostname[i+1:]
+	case strings.HasPrefix(mode, ShardEnvPrefix):
+		name := strings.TrimPrefix(mode, ShardEnvPrefix)
+		var ok bool
+		value, ok = os.LookupEnv(name)
+		if !ok {
+			return 0, errors.Errorf("environment variable %s is not set", name)
+		}
+	default:
+		return 0, errors.Errorf("unknown sharding mode: %s", mode)
+	}
+	ordinal, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || ordinal < 0 {
+		return 0, errors.Errorf("invalid replica ordinal: %q", value)
+	}
+	return ordinal, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+)
+
+const reportTimeout = 30 * time.Second
+
+// Worker talks to the coordinator on behalf of a worker process.
+type Worker struct {
+	CoordinatorURL string
+	HTTPClient     *http.Client
+	assignment     *Assignment
+}
+
+func NewWorker(coordinatorURL string) *Worker {
+	return &Worker{
+		CoordinatorURL: strings.TrimRight(coordinatorURL, "/"),
+		HTTPClient:     &http.Client{},
+	}
+}
+
+// Register joins the run and waits for the coordinator to assign the
+// device range, once all the workers registered.
+func (w *Worker) Register(ctx context.Context) (*Assignment, error) {
+	hostname, _ := os.Hostname()
+	body, err := json.Marshal(&Registration{Hostname: hostname})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		w.CoordinatorURL+urlWorkers, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := w.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close() //nolint:errcheck
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(response.Body)
+		return nil, errors.Errorf("registration failed with status %d: %s",
+			response.StatusCode, strings.TrimSpace(string(message)))
+	}
+	assignment := &Assignment{}
+	err = json.NewDecoder(response.Body).Decode(assignment)
+	if err != nil {
+		return nil, err
+	}
+	w.assignment = assignment
+	return assignment, nil
+}
+
+// Report sends the current metrics to the coordinator; done tells it that
+// the worker stopped.
+func (w *Worker) Report(ctx context.Context, done bool) error {
+	body, err := json.Marshal(&Report{
+		Done:    done,
+		Metrics: metrics.TakeSnapshot(),
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, reportTimeout)
+	defer cancel()
+	url := w.CoordinatorURL + strings.Replace(urlWorkerMetrics, "{id}", w.assignment.ID, 1)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	response, err := w.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		return errors.Errorf("report failed with status %d", response.StatusCode)
+	}
+	return nil
+}
+
+// RunReports sends the metrics to the coordinator at the interval it asked
+// for, until the context is canceled.
+func (w *Worker) RunReports(ctx context.Context) {
+	interval := time.Duration(w.assignment.ReportIntervalMs) * time.Millisecond
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := w.Report(ctx, false)
+			if err != nil && ctx.Err() == nil {
+				log.Warnf("sending the metrics to the coordinator: %s", err)
+			}
+		}
+	}
+}
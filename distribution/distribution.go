@@ -0,0 +1,111 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package distribution draws the random intervals between the requests of
+// the devices, so that the traffic is not perfectly regular.
+package distribution
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// KindFixed always returns the mean interval
+	KindFixed = "fixed"
+	// KindUniform spreads the interval uniformly within ±percent% of
+	// the mean
+	KindUniform = "uniform"
+	// KindExponential draws exponentially distributed intervals, that is
+	// Poisson arrivals
+	KindExponential = "exponential"
+	// KindLogNormal draws log-normally distributed intervals with the given
+	// sigma, i.e. mostly close to the mean with a long tail
+	KindLogNormal = "lognormal"
+)
+
+const defaultLogNormalSigma = 0.5
+
+// Distribution of the intervals around a mean value.
+type Distribution struct {
+	Kind  string
+	Param float64
+}
+
+// Parse parses a distribution specification: fixed, uniform:<percent>,
+// exponential or lognormal[:<sigma>].
+func Parse(spec string) (*Distribution, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	d := &Distribution{Kind: parts[0]}
+	if len(parts) == 2 {
+		param, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid distribution parameter: %s", spec)
+		}
+		d.Param = param
+	}
+	switch d.Kind {
+	case KindFixed, KindExponential:
+		if len(parts) == 2 {
+			return nil, errors.Errorf("the %s distribution takes no parameter",
+				d.Kind)
+		}
+	case KindUniform:
+		if len(parts) != 2 || d.Param < 0 || d.Param > 100 {
+			return nil, errors.Errorf("the uniform distribution requires a "+
+				"percentage between 0 and 100: %s", spec)
+		}
+	case KindLogNormal:
+		if len(parts) != 2 {
+			d.Param = defaultLogNormalSigma
+		} else if d.Param <= 0 {
+			return nil, errors.Errorf("the lognormal distribution requires a "+
+				"positive sigma: %s", spec)
+		}
+	default:
+		return nil, errors.Errorf("unknown distribution: %s", spec)
+	}
+	return d, nil
+}
+
+// IsFixed returns true if the distribution always returns the mean.
+func (d *Distribution) IsFixed() bool {
+	return d == nil || d.Kind == KindFixed
+}
+
+// Sample draws an interval with the given mean.
+func (d *Distribution) Sample(mean time.Duration) time.Duration {
+	if d.IsFixed() || mean <= 0 {
+		return mean
+	}
+	var factor float64
+	switch d.Kind {
+	case KindUniform:
+		factor = 1 + d.Param/100*(2*rand.Float64()-1)
+	case KindExponential:
+		factor = rand.ExpFloat64()
+	case KindLogNormal:
+		// mu is chosen for the mean of the distribution to be one
+		mu := -d.Param * d.Param / 2
+		factor = math.Exp(mu + d.Param*rand.NormFloat64())
+	default:
+		factor = 1
+	}
+	return time.Duration(float64(mean) * factor)
+}
@@ -0,0 +1,153 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package fleet
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/client"
+	"github.com/mendersoftware/mender-stress-test-client/distribution"
+	"github.com/mendersoftware/mender-stress-test-client/key"
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+)
+
+const (
+	metricChurn = "churn_total"
+
+	ChurnDeparture   = "departure"
+	ChurnArrival     = "arrival"
+	ChurnReplacement = "replacement"
+)
+
+// the churn events are Poisson arrivals
+var churnDistribution = &distribution.Distribution{Kind: distribution.KindExponential}
+
+// Churn makes devices leave the fleet for good, new devices join it and
+// devices get replaced by new hardware at the configured rates, until the
+// context is canceled. A device which leaves is never started again; new
+// devices take the next indexes of the arrival range, and replaced devices
+// keep their identity with a new key.
+func (f *Fleet) Churn(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, event := range []struct {
+		name   string
+		rate   float64
+		action func() (bool, error)
+	}{
+		{ChurnDeparture, f.config.ChurnDepartureRate, f.depart},
+		{ChurnArrival, f.config.ChurnArrivalRate, f.arrive},
+		{ChurnReplacement, f.config.ChurnReplacementRate, f.replace},
+	} {
+		if event.rate <= 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, rate float64, action func() (bool, error)) {
+			defer wg.Done()
+			f.churn(ctx, name, rate, action)
+		}(event.name, event.rate, event.action)
+	}
+	wg.Wait()
+}
+
+func (f *Fleet) churn(ctx context.Context, name string, rate float64,
+	action func() (bool, error)) {
+	counter := metrics.GetCounter(metricChurn, "event", name)
+	mean := time.Duration(float64(time.Second) / rate)
+	timer := time.NewTimer(churnDistribution.Sample(mean))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		ok, err := action()
+		if err == ErrNoIndexLeft {
+			log.Warnf("churn: %s: %s, stopping the %ss", name, err, name)
+			return
+		} else if err != nil {
+			log.Errorf("churn: %s: %s", name, err)
+		} else if ok {
+			counter.Inc()
+		}
+		timer.Reset(churnDistribution.Sample(mean))
+	}
+}
+
+// depart stops a random device for good.
+func (f *Fleet) depart() (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.members) == 0 {
+		return false, nil
+	}
+	i := rand.Intn(len(f.members))
+	log.Debugf("churn: device %s left", f.members[i].client.MACAddress)
+	f.stop(i)
+	f.devices.Set(int64(len(f.members)))
+	return true, nil
+}
+
+// arrive starts a device with a new identity.
+func (f *Fleet) arrive() (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	index, err := f.newIndex()
+	if err != nil {
+		return false, err
+	}
+	c, err := client.NewClient(f.config, index)
+	if err != nil {
+		return false, err
+	}
+	log.Debugf("churn: device %s joined", c.MACAddress)
+	f.start(c)
+	f.devices.Set(int64(len(f.members)))
+	return true, nil
+}
+
+// replace restarts a random device with the same identity and a new key,
+// which the server sees as a new authentication set; the device keeps the
+// key when it is restarted later on.
+func (f *Fleet) replace() (bool, error) {
+	// generating the key takes a while, keep it outside of the lock
+	privateKey, publicKey, err := key.NewKeyPair()
+	if err != nil {
+		return false, err
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.members) == 0 {
+		return false, nil
+	}
+	i := rand.Intn(len(f.members))
+	index := f.members[i].client.Index
+	c, err := client.NewClientWithKey(f.config, index, privateKey, publicKey)
+	if err != nil {
+		return false, err
+	}
+	f.keys[index] = &deviceKey{privateKey: privateKey, publicKey: publicKey}
+	log.Debugf("churn: device %s replaced", c.MACAddress)
+	f.stop(i)
+	f.start(c)
+	return true, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package fleet manages the set of devices running in the closed model.
+package fleet
+
+import (
+	"context"
+	"crypto/rsa"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender-stress-test-client/client"
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+const metricDevices = "devices"
+
+// ErrNoIndexLeft is returned when the fleet used all the indexes of its range.
+var ErrNoIndexLeft = errors.New("no device index left in the range of the run " +
+	"(see --shard-size)")
+
+type member struct {
+	client *client.Client
+	cancel context.CancelFunc
+}
+
+// deviceKey is the key of a device replaced with a new key.
+type deviceKey struct {
+	privateKey *rsa.PrivateKey
+	publicKey  []byte
+}
+
+// Fleet keeps track of the running devices. Growing the fleet starts the
+// devices it stopped when shrinking first, then the next indexes from
+// IndexOffset on, continuing with the arrival range after the count;
+// shrinking it stops the most recently started devices.
+type Fleet struct {
+	ctx     context.Context
+	config  *model.RunConfig
+	mutex   sync.Mutex
+	members []*member
+	// indexes of the devices stopped when shrinking, most recent last
+	stopped []int64
+	// keys of the replaced devices by index, which they keep when restarted
+	keys    map[int64]*deviceKey
+	next    int64
+	devices *metrics.Gauge
+}
+
+// NewFleet returns an empty fleet; the devices run until the given context
+// is canceled or the fleet shrinks.
+func NewFleet(ctx context.Context, config *model.RunConfig) *Fleet {
+	return &Fleet{
+		ctx:     ctx,
+		config:  config,
+		keys:    make(map[int64]*deviceKey),
+		next:    config.IndexOffset,
+		devices: metrics.GetGauge(metricDevices),
+	}
+}
+
+// Size returns the number of running devices.
+func (f *Fleet) Size() int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return int64(len(f.members))
+}
+
+// Scale starts or stops devices until the given number of devices run.
+func (f *Fleet) Scale(size int64) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for int64(len(f.members)) < size {
+		var index int64
+		if len(f.stopped) > 0 {
+			index = f.stopped[len(f.stopped)-1]
+			f.stopped = f.stopped[:len(f.stopped)-1]
+		} else {
+			var err error
+			index, err = f.newIndex()
+			if err != nil {
+				f.devices.Set(int64(len(f.members)))
+				return err
+			}
+		}
+		c, err := f.newClient(index)
+		if err != nil {
+			return err
+		}
+		f.start(c)
+	}
+	for int64(len(f.members)) > size && len(f.members) > 0 {
+		last := len(f.members) - 1
+		f.stopped = append(f.stopped, f.members[last].client.Index)
+		f.stop(last)
+	}
+	f.devices.Set(int64(len(f.members)))
+	return nil
+}
+
+// newIndex returns the next index never used.
+func (f *Fleet) newIndex() (int64, error) {
+	if f.next == f.config.IndexOffset+f.config.Count {
+		f.next = f.config.ArrivalIndexOffset
+	}
+	if f.next >= f.config.ArrivalIndexLimit {
+		return 0, ErrNoIndexLeft
+	}
+	f.next++
+	return f.next - 1, nil
+}
+
+// newClient returns the client of the device with the given index, with its
+// own key if it was replaced.
+func (f *Fleet) newClient(index int64) (*client.Client, error) {
+	if k := f.keys[index]; k != nil {
+		return client.NewClientWithKey(f.config, index, k.privateKey, k.publicKey)
+	}
+	return client.NewClient(f.config, index)
+}
+
+// start runs the client as the newest member of the fleet.
+func (f *Fleet) start(c *client.Client) {
+	ctx, cancel := context.WithCancel(f.ctx)
+	f.members = append(f.members, &member{
+		client: c,
+		cancel: cancel,
+	})
+	go c.Run(ctx)
+}
+
+// stop stops the i-th member and removes it from the fleet.
+func (f *Fleet) stop(i int) {
+	f.members[i].cancel()
+	copy(f.members[i:], f.members[i+1:])
+	f.members[len(f.members)-1] = nil
+	f.members = f.members[:len(f.members)-1]
+}
+
+// Reauthenticate makes all the running devices authenticate again.
+func (f *Fleet) Reauthenticate() {
+	f.each((*client.Client).Reauthenticate)
+}
+
+// DropWebsockets closes the websocket connections of all the running
+// devices, which reconnect right away.
+func (f *Fleet) DropWebsockets() {
+	f.each((*client.Client).DropWebsocket)
+}
+
+// Reschedule makes all the running devices apply the current poll intervals
+// right away.
+func (f *Fleet) Reschedule() {
+	f.each((*client.Client).Reschedule)
+}
+
+func (f *Fleet) each(fn func(c *client.Client)) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, m := range f.members {
+		fn(m.client)
+	}
+}
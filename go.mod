@@ -9,4 +9,5 @@ require (
 	github.com/sirupsen/logrus v1.9.4
 	github.com/urfave/cli v1.22.17
 	github.com/vmihailenco/msgpack/v5 v5.4.1
+	golang.org/x/sys v0.13.0
 )
@@ -0,0 +1,314 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package key
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+const (
+	caCommonName         = "mender-stress-test-client CA"
+	caValidity           = 10 * 365 * 24 * time.Hour
+	certificateValidity  = 365 * 24 * time.Hour
+	certificateClockSkew = time.Hour
+	serialNumberBits     = 128
+)
+
+// CertificateIssuer issues the client certificates of the devices, signed by
+// a local CA, for the mutual TLS authentication. The certificates certify the
+// devices' shared private key and are cached on disk across runs, except the
+// ones of the devices replaced with their own key.
+type CertificateIssuer struct {
+	caCert       *x509.Certificate
+	caKey        crypto.Signer
+	deviceKey    *rsa.PrivateKey
+	deviceKeyPEM []byte
+	dir          string
+	mutex        sync.Mutex
+	certs        map[string]*tls.Certificate
+}
+
+func NewCertificateIssuer(config *model.RunConfig) (*CertificateIssuer, error) {
+	caCert, caKey, err := getCertificateAuthority(config.MTLSCACert, config.MTLSCAKey)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(config.MTLSCertDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &CertificateIssuer{
+		caCert:       caCert,
+		caKey:        caKey,
+		deviceKey:    config.PrivateKey,
+		deviceKeyPEM: encodePrivateKeyToPEM(config.PrivateKey),
+		dir:          config.MTLSCertDir,
+		certs:        make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// Certificate returns the client certificate for the given subject common
+// name, loading it from the cache or issuing a new one.
+func (i *CertificateIssuer) Certificate(commonName string) (*tls.Certificate, error) {
+	i.mutex.Lock()
+	cert, ok := i.certs[commonName]
+	i.mutex.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	certFile := filepath.Join(i.dir, strings.ReplaceAll(commonName, ":", "-")+".crt")
+	cert, err := i.loadCertificate(certFile)
+	if err != nil {
+		cert, err = i.issueCertificate(commonName, certFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	i.mutex.Lock()
+	i.certs[commonName] = cert
+	i.mutex.Unlock()
+	return cert, nil
+}
+
+// IssueCertificates makes sure the certificates for all the given common
+// names are available, issuing the missing ones in parallel.
+func (i *CertificateIssuer) IssueCertificates(commonNames []string, workers int) error {
+	var wg sync.WaitGroup
+	var firstErr error
+	var errMutex sync.Mutex
+	queue := make(chan string)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for commonName := range queue {
+				_, err := i.Certificate(commonName)
+				if err != nil {
+					errMutex.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMutex.Unlock()
+				}
+			}
+		}()
+	}
+	for _, commonName := range commonNames {
+		queue <- commonName
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
+
+func (i *CertificateIssuer) loadCertificate(certFile string) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	// fails if the certificate doesn't certify the device key
+	cert, err := tls.X509KeyPair(data, i.deviceKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	err = leaf.CheckSignatureFrom(i.caCert)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return nil, errors.New("certificate expired")
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// CertificateForKey issues a client certificate certifying the given key
+// instead of the shared one; it is not cached.
+func (i *CertificateIssuer) CertificateForKey(commonName string,
+	privateKey *rsa.PrivateKey) (*tls.Certificate, error) {
+	der, err := i.sign(commonName, privateKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("[%s] %-40s", commonName, "client certificate issued for a new key")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return keyPair(data, der, encodePrivateKeyToPEM(privateKey))
+}
+
+func (i *CertificateIssuer) issueCertificate(commonName string,
+	certFile string) (*tls.Certificate, error) {
+	der, err := i.sign(commonName, i.deviceKey.Public())
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	err = ioutil.WriteFile(certFile, data, 0600)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("[%s] %-40s", commonName, "client certificate issued")
+	return keyPair(data, der, i.deviceKeyPEM)
+}
+
+// sign returns the DER encoded certificate of the public key for the given
+// subject common name, signed by the CA.
+func (i *CertificateIssuer) sign(commonName string, publicKey crypto.PublicKey) ([]byte, error) {
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-certificateClockSkew),
+		NotAfter:     now.Add(certificateValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return x509.CreateCertificate(rand.Reader, template, i.caCert, publicKey, i.caKey)
+}
+
+// keyPair returns the TLS certificate of the PEM and DER encoded certificate
+// and the PEM encoded private key.
+func keyPair(certPEM []byte, der []byte, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	cert.Leaf, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func getCertificateAuthority(certFile string,
+	keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		log.Debug("CA certificate doesn't exist, generating it")
+		return generateCertificateAuthority(certFile, keyFile)
+	}
+
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.Errorf("no certificate found in %s", certFile)
+	}
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err = ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ = pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.Errorf("no private key found in %s", keyFile)
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	caKey, ok := parsedKey.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.Errorf("unsupported private key in %s", keyFile)
+	}
+	return caCert, caKey, nil
+}
+
+func generateCertificateAuthority(certFile string,
+	keyFile string) (*x509.Certificate, crypto.Signer, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: caCommonName},
+		NotBefore:             now.Add(-certificateClockSkew),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		caKey.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Info("CA certificate generated")
+	return caCert, caKey, nil
+}
+
+func newSerialNumber() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), serialNumberBits)
+	return rand.Int(rand.Reader, limit)
+}
@@ -36,6 +36,7 @@ func GetPublicPrivateKey(config *model.RunConfig) (*rsa.PrivateKey, []byte, erro
 		if err != nil {
 			return nil, nil, err
 		}
+		log.Info("private key generated")
 		data := encodePrivateKeyToPEM(key)
 		err = ioutil.WriteFile(config.KeyFile, data, 0600)
 		if err != nil {
@@ -56,6 +57,20 @@ func GetPublicPrivateKey(config *model.RunConfig) (*rsa.PrivateKey, []byte, erro
 	return key, publicKey, nil
 }
 
+// NewKeyPair generates a new private key, e.g. for a replaced device, and
+// returns it with its public key in the PEM format.
+func NewKeyPair() (*rsa.PrivateKey, []byte, error) {
+	key, err := generatePrivateKey(keyBitsSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	publicKey, err := encodePublicKeyToPEM(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, publicKey, nil
+}
+
 func generatePrivateKey(bitSize int) (*rsa.PrivateKey, error) {
 	privateKey, err := rsa.GenerateKey(rand.Reader, bitSize)
 	if err != nil {
@@ -65,7 +80,6 @@ func generatePrivateKey(bitSize int) (*rsa.PrivateKey, error) {
 	if err != nil {
 		return nil, err
 	}
-	log.Info("private key generated")
 	return privateKey, nil
 }
 
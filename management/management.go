@@ -0,0 +1,160 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package management
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const urlLogin = "/api/management/v1/useradm/auth/login"
+const urlDevices = "/api/management/v2/devauth/devices"
+const urlDevice = "/api/management/v2/devauth/devices/{id}"
+
+const devicesPerPage = 500
+
+// Device is the subset of the device authentication management API
+// device object the stress client cares about.
+type Device struct {
+	ID           string                 `json:"id"`
+	IdentityData map[string]interface{} `json:"identity_data"`
+	Status       string                 `json:"status"`
+}
+
+// Identity returns the identity attribute of the device, or an empty string
+// if the device doesn't have it or if it is not a string.
+func (d *Device) Identity(name string) string {
+	value, _ := d.IdentityData[name].(string)
+	return value
+}
+
+// Client talks to the management APIs of the Mender server using the
+// credentials of a user.
+type Client struct {
+	ServerURL  string
+	Token      string
+	HTTPClient *http.Client
+}
+
+func NewClient(serverURL string, token string, tlsConfig *tls.Config) *Client {
+	return &Client{
+		ServerURL: strings.TrimRight(serverURL, "/"),
+		Token:     token,
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+			Timeout: time.Minute,
+		},
+	}
+}
+
+// Login obtains a management JWT token using the user's credentials.
+func (c *Client) Login(username string, password string) error {
+	req, err := http.NewRequest(http.MethodPost, c.ServerURL+urlLogin, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(username, password)
+
+	response, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close() //nolint:errcheck
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("login failed: %d %s", response.StatusCode,
+			strings.TrimSpace(string(body)))
+	}
+	c.Token = string(body)
+	return nil
+}
+
+// ListDevices returns all the devices known to device authentication,
+// walking through all the pages.
+func (c *Client) ListDevices() ([]*Device, error) {
+	devices := []*Device{}
+	for page := 1; ; page++ {
+		url := fmt.Sprintf("%s%s?page=%d&per_page=%d", c.ServerURL, urlDevices,
+			page, devicesPerPage)
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Authorization", "Bearer "+c.Token)
+
+		response, err := c.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(response.Body)
+		_ = response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("list devices failed: %d %s",
+				response.StatusCode, strings.TrimSpace(string(body)))
+		}
+
+		pageDevices := []*Device{}
+		err = json.Unmarshal(body, &pageDevices)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, pageDevices...)
+		log.Debugf("listed %d devices (page %d)", len(devices), page)
+
+		if len(pageDevices) < devicesPerPage {
+			return devices, nil
+		}
+	}
+}
+
+// DecommissionDevice removes the device and all its data from the server.
+func (c *Client) DecommissionDevice(deviceID string) error {
+	url := c.ServerURL + strings.Replace(urlDevice, "{id}", deviceID, 1)
+	req, err := http.NewRequest(http.MethodDelete, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Authorization", "Bearer "+c.Token)
+
+	response, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent &&
+		response.StatusCode != http.StatusNotFound {
+		return errors.Errorf("decommission device %s failed: %d", deviceID,
+			response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// bucket upper bounds of the histograms, in seconds
+var buckets = [...]float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60,
+}
+
+// Histogram counts the observed durations in buckets.
+type Histogram struct {
+	// counts has one more bucket than the bounds, for +Inf
+	counts [len(buckets) + 1]int64
+	sum    int64
+}
+
+// HistogramSnapshot holds the bucket counts of a histogram at a given time.
+type HistogramSnapshot struct {
+	Counts [len(buckets) + 1]int64
+	Count  int64
+	// Sum of the observed durations
+	Sum time.Duration
+}
+
+// GetHistogram returns the histogram with the given name and labels, passed
+// as key, value pairs, creating it if needed.
+func GetHistogram(name string, labels ...string) *Histogram {
+	return getMetric(name, typeHistogram, labels, func() valuer {
+		return &Histogram{}
+	}).(*Histogram)
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := 0
+	for i < len(buckets) && seconds > buckets[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// Value returns the number of observations.
+func (h *Histogram) Value() int64 {
+	return h.Snapshot().Count
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Sum: time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadInt64(&h.counts[i])
+		s.Count += s.Counts[i]
+	}
+	return s
+}
+
+// Sub returns the observations made since the previous snapshot.
+func (s HistogramSnapshot) Sub(previous HistogramSnapshot) HistogramSnapshot {
+	for i := range s.Counts {
+		s.Counts[i] -= previous.Counts[i]
+	}
+	s.Count -= previous.Count
+	s.Sum -= previous.Sum
+	return s
+}
+
+// Quantile estimates the given quantile, between 0 and 1, interpolating
+// linearly within the bucket it falls in.
+func (s HistogramSnapshot) Quantile(q float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := q * float64(s.Count)
+	cumulative := int64(0)
+	for i, count := range s.Counts {
+		if count == 0 || float64(cumulative+count) < rank {
+			cumulative += count
+			continue
+		}
+		if i == len(buckets) {
+			// the +Inf bucket has no upper bound
+			return seconds(buckets[i-1])
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = buckets[i-1]
+		}
+		ratio := (rank - float64(cumulative)) / float64(count)
+		return seconds(lower + (buckets[i]-lower)*ratio)
+	}
+	return seconds(buckets[len(buckets)-1])
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,180 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const namespace = "mender_stress_"
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+type Counter struct {
+	value int64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.value, 1)
+}
+
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.value, n)
+}
+
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.value)
+}
+
+type Gauge struct {
+	value int64
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.value, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.value, -1)
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.value, n)
+}
+
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.value, n)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+type valuer interface {
+	Value() int64
+}
+
+type metric struct {
+	name      string
+	labels    string
+	rawLabels []string
+	kind      string
+	value     valuer
+}
+
+// Sample is the current value of a metric, as returned by Find.
+type Sample struct {
+	Labels map[string]string
+	Value  int64
+	// Histogram is set for the histograms only
+	Histogram *Histogram
+}
+
+var (
+	mutex   sync.Mutex
+	metrics = map[string]*metric{}
+)
+
+// GetCounter returns the counter with the given name and labels, passed as
+// key, value pairs, creating it if needed.
+func GetCounter(name string, labels ...string) *Counter {
+	return getMetric(name, typeCounter, labels, func() valuer {
+		return &Counter{}
+	}).(*Counter)
+}
+
+// GetGauge returns the gauge with the given name and labels, passed as
+// key, value pairs, creating it if needed.
+func GetGauge(name string, labels ...string) *Gauge {
+	return getMetric(name, typeGauge, labels, func() valuer {
+		return &Gauge{}
+	}).(*Gauge)
+}
+
+func getMetric(name string, kind string, labels []string, create func() valuer) valuer {
+	formatted := formatLabels(labels)
+	key := name + formatted
+	mutex.Lock()
+	defer mutex.Unlock()
+	m, ok := metrics[key]
+	if !ok {
+		m = &metric{
+			name:      name,
+			labels:    formatted,
+			rawLabels: labels,
+			kind:      kind,
+			value:     create(),
+		}
+		metrics[key] = m
+	}
+	return m.value
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Find returns all the metrics with the given name, whatever their labels.
+func Find(name string) []Sample {
+	mutex.Lock()
+	defer mutex.Unlock()
+	samples := []Sample{}
+	for _, m := range metrics {
+		if m.name != name {
+			continue
+		}
+		sample := Sample{
+			Labels: make(map[string]string, len(m.rawLabels)/2),
+			Value:  m.value.Value(),
+		}
+		for i := 0; i+1 < len(m.rawLabels); i += 2 {
+			sample.Labels[m.rawLabels[i]] = m.rawLabels[i+1]
+		}
+		sample.Histogram, _ = m.value.(*Histogram)
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+// Write writes all the metrics in the Prometheus text exposition format.
+func Write(w io.Writer) error {
+	return TakeSnapshot().Write(w)
+}
+
+// ListenAndServe exposes the metrics over HTTP on the given address.
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_ = Write(w)
+	})
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,174 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// SnapshotMetric is the value of a metric at a given time.
+type SnapshotMetric struct {
+	Name      string             `json:"name"`
+	Kind      string             `json:"kind"`
+	Labels    []string           `json:"labels,omitempty"`
+	Value     int64              `json:"value"`
+	Histogram *HistogramSnapshot `json:"histogram,omitempty"`
+}
+
+// Snapshot holds the values of all the metrics at a given time, sorted by
+// name and labels; the snapshots of several processes can be merged.
+type Snapshot []SnapshotMetric
+
+// TakeSnapshot returns the current values of all the metrics.
+func TakeSnapshot() Snapshot {
+	mutex.Lock()
+	all := make([]*metric, 0, len(metrics))
+	for _, m := range metrics {
+		all = append(all, m)
+	}
+	mutex.Unlock()
+
+	snapshot := make(Snapshot, 0, len(all))
+	for _, m := range all {
+		sm := SnapshotMetric{
+			Name:   m.name,
+			Kind:   m.kind,
+			Labels: m.rawLabels,
+			Value:  m.value.Value(),
+		}
+		if h, ok := m.value.(*Histogram); ok {
+			hs := h.Snapshot()
+			sm.Histogram = &hs
+			sm.Value = hs.Count
+		}
+		snapshot = append(snapshot, sm)
+	}
+	snapshot.sort()
+	return snapshot
+}
+
+// Merge sums the values of the same metrics over the given snapshots.
+func Merge(snapshots ...Snapshot) Snapshot {
+	merged := map[string]*SnapshotMetric{}
+	for _, snapshot := range snapshots {
+		for _, sm := range snapshot {
+			key := sm.Name + formatLabels(sm.Labels)
+			m, ok := merged[key]
+			if !ok {
+				m = &SnapshotMetric{
+					Name:   sm.Name,
+					Kind:   sm.Kind,
+					Labels: sm.Labels,
+				}
+				if sm.Histogram != nil {
+					m.Histogram = &HistogramSnapshot{}
+				}
+				merged[key] = m
+			}
+			m.Value += sm.Value
+			if m.Histogram != nil && sm.Histogram != nil {
+				for i, count := range sm.Histogram.Counts {
+					m.Histogram.Counts[i] += count
+				}
+				m.Histogram.Count += sm.Histogram.Count
+				m.Histogram.Sum += sm.Histogram.Sum
+			}
+		}
+	}
+	snapshot := make(Snapshot, 0, len(merged))
+	for _, m := range merged {
+		snapshot = append(snapshot, *m)
+	}
+	snapshot.sort()
+	return snapshot
+}
+
+// Find returns the metrics with the given name, whatever their labels.
+func (s Snapshot) Find(name string) []SnapshotMetric {
+	found := []SnapshotMetric{}
+	for _, sm := range s {
+		if sm.Name == name {
+			found = append(found, sm)
+		}
+	}
+	return found
+}
+
+// Label returns the value of the given label.
+func (sm *SnapshotMetric) Label(name string) string {
+	for i := 0; i+1 < len(sm.Labels); i += 2 {
+		if sm.Labels[i] == name {
+			return sm.Labels[i+1]
+		}
+	}
+	return ""
+}
+
+// Write writes the metrics in the Prometheus text exposition format.
+func (s Snapshot) Write(w io.Writer) error {
+	for i, sm := range s {
+		if i == 0 || s[i-1].Name != sm.Name {
+			_, err := fmt.Fprintf(w, "# TYPE %s%s %s\n", namespace, sm.Name, sm.Kind)
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		if sm.Histogram != nil {
+			err = writeHistogram(w, namespace+sm.Name, sm.Labels, sm.Histogram)
+		} else {
+			_, err = fmt.Fprintf(w, "%s%s%s %d\n", namespace, sm.Name,
+				formatLabels(sm.Labels), sm.Value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHistogram(w io.Writer, name string, labels []string,
+	h *HistogramSnapshot) error {
+	cumulative := int64(0)
+	for i, count := range h.Counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(buckets) {
+			le = strconv.FormatFloat(buckets[i], 'g', -1, 64)
+		}
+		bucketLabels := append(append([]string{}, labels...), "le", le)
+		_, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name,
+			formatLabels(bucketLabels), cumulative)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n",
+		name, formatLabels(labels), h.Sum.Seconds(), name, formatLabels(labels),
+		h.Count)
+	return err
+}
+
+func (s Snapshot) sort() {
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Name != s[j].Name {
+			return s[i].Name < s[j].Name
+		}
+		return formatLabels(s[i].Labels) < formatLabels(s[j].Labels)
+	})
+}
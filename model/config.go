@@ -16,28 +16,146 @@ package model
 
 import (
 	"crypto/rsa"
+	"crypto/tls"
+	"net"
+	"net/url"
 	"time"
+
+	"github.com/mendersoftware/mender-stress-test-client/distribution"
+	"github.com/mendersoftware/mender-stress-test-client/netem"
+	"github.com/mendersoftware/mender-stress-test-client/vfs"
 )
 
 type RunConfig struct {
-	Count                     int64
-	KeyFile                   string
-	MACAddressPrefix          string
-	DeviceType                string
-	ArtifactName              string
-	RootfsImageChecksum       string
-	InventoryAttributes       []string
-	InventoryAttributesRandom []string
-	ExtraIdentity             map[string]string
-	StartTime                 time.Duration
-	AuthInterval              time.Duration
-	InventoryInterval         time.Duration
-	UpdateInterval            time.Duration
-	DeploymentTime            time.Duration
-	ServerURL                 string
-	TenantToken               string
-	PrivateKey                *rsa.PrivateKey
-	PublicKey                 []byte
-	Websocket                 bool
-	Tier                      *string
+	Count                         int64
+	IndexOffset                   int64
+	ArrivalIndexOffset            int64
+	ArrivalIndexLimit             int64
+	Shard                         string
+	KeyFile                       string
+	MACAddressPrefix              string
+	DeviceType                    string
+	ArtifactName                  string
+	RootfsImageChecksum           string
+	InventoryAttributes           []string
+	InventoryAttributesRandom     []string
+	ExtraIdentity                 map[string]string
+	StartTime                     time.Duration
+	AuthInterval                  time.Duration
+	InventoryInterval             time.Duration
+	UpdateInterval                time.Duration
+	DeploymentTime                time.Duration
+	DeploymentFailureRate         float64
+	DeploymentLogLines            int
+	DeploymentLogSize             int
+	ChurnDepartureRate            float64
+	ChurnArrivalRate              float64
+	ChurnReplacementRate          float64
+	AuthIntervalDistribution      *distribution.Distribution
+	InventoryIntervalDistribution *distribution.Distribution
+	UpdateIntervalDistribution    *distribution.Distribution
+	DeploymentTimeDistribution    *distribution.Distribution
+	Lockstep                      bool
+	LockstepSkew                  time.Duration
+	ServerURL                     string
+	TenantToken                   string
+	PrivateKey                    *rsa.PrivateKey
+	PublicKey                     []byte
+	Websocket                     bool
+	WebsocketDisconnectInterval   time.Duration
+	WebsocketReconnect            string
+	WebsocketReconnectInterval    time.Duration
+	WebsocketReconnectMaxInterval time.Duration
+	ShellMaxSessions              int
+	ShellScript                   map[string]string
+	VirtualFiles                  []*vfs.File
+	PortForwardTargets            map[int]string
+	Configure                     bool
+	ConfigureAttributes           []string
+	ConfigureApplyTime            time.Duration
+	ConfigureFailureRate          float64
+	Monitor                       bool
+	MonitorServices               []*MonitorService
+	MonitorAlertInterval          time.Duration
+	MonitorRecoveryTime           time.Duration
+	MonitorFlappingProbability    float64
+	MonitorStormInterval          time.Duration
+	Tier                          *string
+	HTTPTransport                 string
+	HTTPKeepAlive                 bool
+	HTTPMaxConnectionLifetime     time.Duration
+	HTTPVersion                   string
+	TLS                           TLSConfig
+	TLSClientConfig               *tls.Config
+	MTLS                          bool
+	MTLSCACert                    string
+	MTLSCAKey                     string
+	MTLSCertDir                   string
+	MTLSWorkers                   int
+	CertificateIssuer             CertificateIssuer
+	Proxies                       []*url.URL
+	ProxyAssignment               string
+	SourceAddresses               []net.IP
+	SourceAddressAssignment       string
+	NetworkProfiles               []*netem.Profile
+	MetricsListen                 string
+	ConnectTimeout                time.Duration
+	TLSHandshakeTimeout           time.Duration
+	ResponseHeaderTimeout         time.Duration
+	RequestTimeout                time.Duration
+	OpenModel                     bool
+	AuthRate                      float64
+	InventoryRate                 float64
+	UpdateRate                    float64
+	RateBurst                     int
+	MaxInFlight                   int
+	ReportInterval                time.Duration
+	RampProfile                   string
+	RampStepSize                  int64
+	RampStepInterval              time.Duration
+	RampPoints                    string
+	HoldTime                      time.Duration
+	RampDownTime                  time.Duration
+	AdminListen                   string
+	TUI                           bool
+	Settings                      *Settings
+}
+
+// CertificateIssuer provides the client certificates of the devices for
+// the mutual TLS authentication.
+type CertificateIssuer interface {
+	Certificate(commonName string) (*tls.Certificate, error)
+	CertificateForKey(commonName string, privateKey *rsa.PrivateKey) (*tls.Certificate, error)
+}
+
+type CleanupConfig struct {
+	ServerURL        string
+	Token            string
+	Username         string
+	Password         string
+	Count            int64
+	IndexOffset      int64
+	ArrivalCount     int64
+	MACAddressPrefix string
+	IdentityMarkers  map[string]string
+	Concurrency      int
+	DryRun           bool
+	TLS              TLSConfig
+}
+
+type TLSConfig struct {
+	CACert           string
+	ServerName       string
+	PinnedPublicKeys []string
+	Insecure         bool
+}
+
+type CoordinatorConfig struct {
+	Listen         string
+	Workers        int
+	Count          int64
+	ArrivalIndexes int64
+	Args           []string
+	StartDelay     time.Duration
+	ReportInterval time.Duration
 }
@@ -41,3 +41,13 @@ type ArtifactSource struct {
 type DeploymentStatus struct {
 	Status string `json:"status"`
 }
+
+type DeploymentLog struct {
+	Messages []DeploymentLogMessage `json:"messages"`
+}
+
+type DeploymentLogMessage struct {
+	Timestamp time.Time `json:"timestamp"`
+	Level     string    `json:"level"`
+	Message   string    `json:"message"`
+}
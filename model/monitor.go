@@ -0,0 +1,43 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import "time"
+
+// alert levels
+const (
+	AlertLevelCritical = "CRITICAL"
+	AlertLevelOK       = "OK"
+)
+
+// MonitorService is a service or log pattern watched by the monitor add-on.
+type MonitorService struct {
+	Name string
+	Type string
+}
+
+type Alert struct {
+	Name      string       `json:"name"`
+	Level     string       `json:"level"`
+	Subject   AlertSubject `json:"subject"`
+	Timestamp time.Time    `json:"timestamp"`
+}
+
+type AlertSubject struct {
+	Name    string                 `json:"name"`
+	Type    string                 `json:"type"`
+	Status  string                 `json:"status"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
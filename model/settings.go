@@ -0,0 +1,64 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package model
+
+import (
+	"sync"
+	"time"
+)
+
+// SettingsValues are the device parameters which can be changed while the
+// clients run.
+type SettingsValues struct {
+	AuthInterval          time.Duration
+	InventoryInterval     time.Duration
+	UpdateInterval        time.Duration
+	DeploymentTime        time.Duration
+	DeploymentFailureRate float64
+	Paused                bool
+}
+
+// Settings holds the current settings values shared by all the clients.
+type Settings struct {
+	mutex  sync.RWMutex
+	values SettingsValues
+}
+
+func NewSettings(config *RunConfig) *Settings {
+	return &Settings{
+		values: SettingsValues{
+			AuthInterval:          config.AuthInterval,
+			InventoryInterval:     config.InventoryInterval,
+			UpdateInterval:        config.UpdateInterval,
+			DeploymentTime:        config.DeploymentTime,
+			DeploymentFailureRate: config.DeploymentFailureRate,
+		},
+	}
+}
+
+// Get returns a copy of the current values.
+func (s *Settings) Get() SettingsValues {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.values
+}
+
+// Update changes the values with the given function.
+func (s *Settings) Update(update func(values *SettingsValues)) SettingsValues {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	update(&s.values)
+	return s.values
+}
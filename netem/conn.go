@@ -0,0 +1,227 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package netem
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+)
+
+const (
+	metricStalls = "network_stalls_total"
+	metricResets = "network_resets_total"
+)
+
+var (
+	errReset  = errors.New("connection reset by the network emulation")
+	errClosed = errors.New("use of closed network connection")
+)
+
+// WaitDial waits for the round trip of the TCP handshake.
+func WaitDial(ctx context.Context, profile *Profile) error {
+	timer := time.NewTimer(2 * profile.oneWay())
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Conn applies the network conditions of the profile to a connection. The
+// latency is added once per exchange: to the first write of a request and
+// to the first read of the response. The delays end early when the
+// connection is closed or reaches its deadline.
+type Conn struct {
+	net.Conn
+	profile *Profile
+	// turn is 1 when the last operation was a write, 0 after a read
+	turn       int32
+	readPacer  pacer
+	writePacer pacer
+	stalls     *metrics.Counter
+	resets     *metrics.Counter
+	closed     chan struct{}
+	closeOnce  sync.Once
+	mutex      sync.Mutex
+	readUntil  time.Time
+	writeUntil time.Time
+}
+
+func NewConn(conn net.Conn, profile *Profile) *Conn {
+	return &Conn{
+		Conn:    conn,
+		profile: profile,
+		stalls:  metrics.GetCounter(metricStalls, "profile", profile.Name),
+		resets:  metrics.GetCounter(metricResets, "profile", profile.Name),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readUntil, c.writeUntil = t, t
+	c.mutex.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.readUntil = t
+	c.mutex.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.writeUntil = t
+	c.mutex.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	err := c.disturb("read")
+	if err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		delay := c.readPacer.delay(n, c.profile.Downlink)
+		if atomic.CompareAndSwapInt32(&c.turn, 1, 0) {
+			delay += c.profile.oneWay()
+		}
+		if waitErr := c.wait("read", delay); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	err := c.disturb("write")
+	if err != nil {
+		return 0, err
+	}
+	delay := c.writePacer.delay(len(b), c.profile.Uplink)
+	if atomic.CompareAndSwapInt32(&c.turn, 0, 1) {
+		delay += c.profile.oneWay()
+	}
+	err = c.wait("write", delay)
+	if err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// disturb stalls or resets the connection, at random.
+func (c *Conn) disturb(op string) error {
+	if c.profile.ResetProbability > 0 && rand.Float64() < c.profile.ResetProbability {
+		c.resets.Inc()
+		_ = c.Close()
+		return c.opError(op, errReset)
+	}
+	if c.profile.StallProbability > 0 && rand.Float64() < c.profile.StallProbability {
+		c.stalls.Inc()
+		return c.wait(op, c.profile.StallTime)
+	}
+	return nil
+}
+
+// wait waits for the delay, unless the connection is closed or reaches the
+// deadline of the operation first.
+func (c *Conn) wait(op string, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	c.mutex.Lock()
+	deadline := c.readUntil
+	if op == "write" {
+		deadline = c.writeUntil
+	}
+	c.mutex.Unlock()
+	var err error
+	if !deadline.IsZero() && time.Until(deadline) < delay {
+		delay = time.Until(deadline)
+		err = c.opError(op, os.ErrDeadlineExceeded)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-c.closed:
+		return c.opError(op, errClosed)
+	case <-timer.C:
+		return err
+	}
+}
+
+func (c *Conn) opError(op string, err error) error {
+	return &net.OpError{
+		Op:     op,
+		Net:    c.Conn.LocalAddr().Network(),
+		Source: c.Conn.LocalAddr(),
+		Addr:   c.Conn.RemoteAddr(),
+		Err:    err,
+	}
+}
+
+// oneWay returns half of a round-trip time, with jitter.
+func (p *Profile) oneWay() time.Duration {
+	rtt := p.RTT
+	if p.Jitter > 0 {
+		rtt += time.Duration(rand.Int63n(int64(2*p.Jitter))) - p.Jitter
+	}
+	if rtt < 0 {
+		return 0
+	}
+	return rtt / 2
+}
+
+// pacer spaces the transfers to match the bandwidth.
+type pacer struct {
+	mutex sync.Mutex
+	next  time.Time
+}
+
+// delay returns the time to wait before n more bytes are transferred.
+func (p *pacer) delay(n int, bandwidth int64) time.Duration {
+	if bandwidth <= 0 {
+		return 0
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	p.next = p.next.Add(time.Duration(float64(n) / float64(bandwidth) * float64(time.Second)))
+	return p.next.Sub(now)
+}
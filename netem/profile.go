@@ -0,0 +1,216 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package netem emulates the network conditions of the devices: latency,
+// limited bandwidth, stalls and connection resets.
+package netem
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProfileCustom is the name of the profiles given by their parameters.
+const ProfileCustom = "custom"
+
+// Profile describes the network conditions of a device.
+type Profile struct {
+	Name string
+	// Weight is the share of the devices using the profile, relative to
+	// the weights of the other profiles
+	Weight int
+	// RTT is the round-trip time added to the connections, varying by up
+	// to ±Jitter
+	RTT    time.Duration
+	Jitter time.Duration
+	// Downlink and Uplink are the bandwidths in bytes per second; zero
+	// means unlimited
+	Downlink int64
+	Uplink   int64
+	// StallProbability is the probability that a read or write stalls
+	// for StallTime
+	StallProbability float64
+	StallTime        time.Duration
+	// ResetProbability is the probability that a read or write resets
+	// the connection
+	ResetProbability float64
+}
+
+const kbit = 1000 / 8
+
+var profiles = map[string]Profile{
+	"wifi": {
+		RTT:      20 * time.Millisecond,
+		Jitter:   5 * time.Millisecond,
+		Downlink: 20000 * kbit,
+		Uplink:   10000 * kbit,
+	},
+	"cellular-4G": {
+		RTT:              60 * time.Millisecond,
+		Jitter:           20 * time.Millisecond,
+		Downlink:         10000 * kbit,
+		Uplink:           5000 * kbit,
+		StallProbability: 0.001,
+		StallTime:        time.Second,
+		ResetProbability: 0.0005,
+	},
+	"cellular-3G": {
+		RTT:              200 * time.Millisecond,
+		Jitter:           50 * time.Millisecond,
+		Downlink:         1500 * kbit,
+		Uplink:           750 * kbit,
+		StallProbability: 0.005,
+		StallTime:        2 * time.Second,
+		ResetProbability: 0.001,
+	},
+	"cellular-2G": {
+		RTT:              650 * time.Millisecond,
+		Jitter:           150 * time.Millisecond,
+		Downlink:         100 * kbit,
+		Uplink:           50 * kbit,
+		StallProbability: 0.02,
+		StallTime:        5 * time.Second,
+		ResetProbability: 0.005,
+	},
+	"satellite": {
+		RTT:              600 * time.Millisecond,
+		Jitter:           50 * time.Millisecond,
+		Downlink:         10000 * kbit,
+		Uplink:           2000 * kbit,
+		StallProbability: 0.005,
+		StallTime:        2 * time.Second,
+		ResetProbability: 0.001,
+	},
+	"lossy": {
+		RTT:              100 * time.Millisecond,
+		Jitter:           100 * time.Millisecond,
+		Downlink:         1000 * kbit,
+		Uplink:           1000 * kbit,
+		StallProbability: 0.05,
+		StallTime:        3 * time.Second,
+		ResetProbability: 0.02,
+	},
+}
+
+// Names returns the names of the predefined profiles.
+func Names() []string {
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Parse parses a profile specification: the name of a predefined profile or
+// a comma-separated list of parameters, e.g.
+// rtt=300ms,jitter=50ms,down=2000,up=500,stall=0.01,stall-time=2s,reset=0.001
+// with the bandwidths in kbit/s, optionally followed by @<weight>.
+func Parse(spec string) (*Profile, error) {
+	weight := 1
+	if i := strings.LastIndex(spec, "@"); i >= 0 {
+		var err error
+		weight, err = strconv.Atoi(spec[i+1:])
+		if err != nil || weight < 1 {
+			return nil, errors.Errorf("invalid network profile weight: %s", spec)
+		}
+		spec = spec[:i]
+	}
+	if !strings.Contains(spec, "=") {
+		profile, ok := profiles[spec]
+		if !ok {
+			return nil, errors.Errorf("unknown network profile: %s", spec)
+		}
+		profile.Name = spec
+		profile.Weight = weight
+		return &profile, nil
+	}
+
+	profile := &Profile{Name: ProfileCustom, Weight: weight}
+	for _, param := range strings.Split(spec, ",") {
+		keyValue := strings.SplitN(param, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, errors.Errorf("invalid network profile parameter: %s", param)
+		}
+		err := profile.set(keyValue[0], keyValue[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid network profile parameter %s", param)
+		}
+	}
+	return profile, nil
+}
+
+func (p *Profile) set(key, value string) error {
+	var err error
+	switch key {
+	case "rtt":
+		p.RTT, err = time.ParseDuration(value)
+	case "jitter":
+		p.Jitter, err = time.ParseDuration(value)
+	case "down":
+		p.Downlink, err = parseBandwidth(value)
+	case "up":
+		p.Uplink, err = parseBandwidth(value)
+	case "stall":
+		p.StallProbability, err = parseProbability(value)
+	case "stall-time":
+		p.StallTime, err = time.ParseDuration(value)
+	case "reset":
+		p.ResetProbability, err = parseProbability(value)
+	default:
+		return errors.New("unknown parameter")
+	}
+	return err
+}
+
+func parseBandwidth(value string) (int64, error) {
+	kbits, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || kbits < 0 {
+		return 0, errors.New("the bandwidth must be a number of kbit/s")
+	}
+	return kbits * kbit, nil
+}
+
+func parseProbability(value string) (float64, error) {
+	p, err := strconv.ParseFloat(value, 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0, errors.New("the probability must be between 0 and 1")
+	}
+	return p, nil
+}
+
+// Assign returns the profile of the device with the given index, spreading
+// the devices over the profiles in proportion to their weights; it returns
+// nil if there are no profiles.
+func Assign(profiles []*Profile, index int64) *Profile {
+	total := int64(0)
+	for _, p := range profiles {
+		total += int64(p.Weight)
+	}
+	if total == 0 {
+		return nil
+	}
+	position := index % total
+	for _, p := range profiles {
+		position -= int64(p.Weight)
+		if position < 0 {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package ramp implements the load shapes: how many devices run at any
+// point in time since the start of the run.
+package ramp
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+const (
+	ProfileLinear      = "linear"
+	ProfileStepped     = "stepped"
+	ProfileExponential = "exponential"
+	ProfileCustom      = "custom"
+)
+
+const tickInterval = 100 * time.Millisecond
+
+// Profile returns the number of devices which should run after the given
+// time since the start, and whether the profile is over.
+type Profile func(elapsed time.Duration) (devices int64, done bool)
+
+// Scaler is the fleet of devices the profile is applied to.
+type Scaler interface {
+	Scale(size int64) error
+}
+
+type point struct {
+	at      time.Duration
+	devices int64
+}
+
+// NewProfile builds the profile from the ramp-up and ramp-down settings.
+func NewProfile(config *model.RunConfig) (Profile, error) {
+	switch config.RampProfile {
+	case ProfileLinear:
+		return withRampDown(config, config.StartTime, linear(config)), nil
+	case ProfileStepped:
+		if config.RampStepSize < 1 || config.RampStepInterval <= 0 {
+			return nil, errors.New("the stepped profile requires a positive " +
+				"step size and interval")
+		}
+		steps := (config.Count + config.RampStepSize - 1) / config.RampStepSize
+		rampUp := time.Duration(steps-1) * config.RampStepInterval
+		return withRampDown(config, rampUp, stepped(config)), nil
+	case ProfileExponential:
+		return withRampDown(config, config.StartTime, exponential(config)), nil
+	case ProfileCustom:
+		if config.HoldTime > 0 || config.RampDownTime > 0 {
+			return nil, errors.New("the custom profile doesn't take a hold or " +
+				"ramp-down time: add them to the points")
+		}
+		points, err := parsePoints(config.RampPoints)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range points {
+			if p.devices > config.Count {
+				return nil, errors.Errorf("ramp point exceeds the number of "+
+					"clients: %d", p.devices)
+			}
+		}
+		return custom(points), nil
+	}
+	return nil, errors.Errorf("unknown ramp profile: %s", config.RampProfile)
+}
+
+// Run applies the profile to the fleet until the profile is over or the
+// context is canceled.
+func Run(ctx context.Context, profile Profile, fleet Scaler) error {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	start := time.Now()
+	last := int64(-1)
+	for {
+		devices, done := profile(time.Since(start))
+		if devices != last {
+			log.Debugf("ramp: %d devices", devices)
+			err := fleet.Scale(devices)
+			if err != nil {
+				return err
+			}
+			last = devices
+		}
+		if done {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func linear(config *model.RunConfig) Profile {
+	return func(elapsed time.Duration) (int64, bool) {
+		if elapsed >= config.StartTime {
+			return config.Count, false
+		}
+		return int64(float64(config.Count) * float64(elapsed) /
+			float64(config.StartTime)), false
+	}
+}
+
+func stepped(config *model.RunConfig) Profile {
+	return func(elapsed time.Duration) (int64, bool) {
+		devices := (int64(elapsed/config.RampStepInterval) + 1) * config.RampStepSize
+		if devices > config.Count {
+			devices = config.Count
+		}
+		return devices, false
+	}
+}
+
+// exponential grows from one device to the full fleet, multiplying the
+// number of devices by the same factor in each time unit.
+func exponential(config *model.RunConfig) Profile {
+	return func(elapsed time.Duration) (int64, bool) {
+		if elapsed >= config.StartTime || config.Count < 1 {
+			return config.Count, false
+		}
+		exponent := float64(elapsed) / float64(config.StartTime)
+		return int64(math.Pow(float64(config.Count), exponent)), false
+	}
+}
+
+// withRampDown holds the full fleet for the hold time after the ramp-up and
+// then removes the devices over the ramp-down time: in steps for the stepped
+// profile, linearly otherwise. A zero hold time holds forever.
+func withRampDown(config *model.RunConfig, rampUp time.Duration, up Profile) Profile {
+	if config.HoldTime <= 0 {
+		return up
+	}
+	rampDownStart := rampUp + config.HoldTime
+	return func(elapsed time.Duration) (int64, bool) {
+		if elapsed < rampDownStart {
+			return up(elapsed)
+		}
+		down := elapsed - rampDownStart
+		if config.RampProfile == ProfileStepped {
+			removed := (int64(down/config.RampStepInterval) + 1) * config.RampStepSize
+			if removed >= config.Count {
+				return 0, true
+			}
+			return config.Count - removed, false
+		}
+		if down >= config.RampDownTime {
+			return 0, true
+		}
+		remaining := 1 - float64(down)/float64(config.RampDownTime)
+		return int64(math.Ceil(float64(config.Count) * remaining)), false
+	}
+}
+
+// custom interpolates linearly between the given points, holding the last
+// number of devices forever, or stopping if it is zero.
+func custom(points []point) Profile {
+	return func(elapsed time.Duration) (int64, bool) {
+		last := points[len(points)-1]
+		if elapsed >= last.at {
+			return last.devices, last.devices == 0
+		}
+		i := sort.Search(len(points), func(i int) bool {
+			return points[i].at > elapsed
+		})
+		if i == 0 {
+			return points[0].devices, false
+		}
+		from, to := points[i-1], points[i]
+		ratio := float64(elapsed-from.at) / float64(to.at-from.at)
+		return from.devices + int64(math.Round(
+			ratio*float64(to.devices-from.devices))), false
+	}
+}
+
+// parsePoints parses a list of seconds:devices points, e.g.
+// 0:0,60:1000,300:1000,360:0
+func parsePoints(spec string) ([]point, error) {
+	points := []point{}
+	for _, item := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid ramp point: %s", item)
+		}
+		seconds, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || seconds < 0 {
+			return nil, errors.Errorf("invalid ramp point time: %s", item)
+		}
+		devices, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || devices < 0 {
+			return nil, errors.Errorf("invalid ramp point devices: %s", item)
+		}
+		at := time.Duration(seconds * float64(time.Second))
+		if len(points) > 0 && at <= points[len(points)-1].at {
+			return nil, errors.Errorf("ramp points must be in increasing time "+
+				"order: %s", item)
+		}
+		points = append(points, point{at: at, devices: devices})
+	}
+	return points, nil
+}
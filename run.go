@@ -15,11 +15,23 @@
 package main
 
 import (
-	"time"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/admin"
 	"github.com/mendersoftware/mender-stress-test-client/client"
+	"github.com/mendersoftware/mender-stress-test-client/fleet"
 	"github.com/mendersoftware/mender-stress-test-client/key"
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
 	"github.com/mendersoftware/mender-stress-test-client/model"
+	"github.com/mendersoftware/mender-stress-test-client/ramp"
+	"github.com/mendersoftware/mender-stress-test-client/scheduler"
+	"github.com/mendersoftware/mender-stress-test-client/transport"
+	"github.com/mendersoftware/mender-stress-test-client/tui"
 )
 
 func run(config *model.RunConfig) error {
@@ -31,15 +43,118 @@ func run(config *model.RunConfig) error {
 	config.PrivateKey = key
 	config.PublicKey = publicKey
 
-	for i := int64(0); i < config.Count; i++ {
-		client, err := client.NewClient(config, i)
+	config.Settings = model.NewSettings(config)
+
+	config.TLSClientConfig, err = transport.NewTLSConfig(&config.TLS)
+	if err != nil {
+		return err
+	}
+
+	if config.MetricsListen != "" {
+		go func() {
+			err := metrics.ListenAndServe(config.MetricsListen)
+			log.Errorf("metrics: %s", err)
+		}()
+	}
+
+	if config.MTLS {
+		err = issueCertificates(config)
 		if err != nil {
 			return err
 		}
-		go client.Run()
+	}
+
+	ctx, cancel := withSignals(context.Background())
+	defer cancel()
+
+	if config.OpenModel {
+		return runOpenModel(ctx, config)
+	}
+
+	profile, err := ramp.NewProfile(config)
+	if err != nil {
+		return err
+	}
+	devices := fleet.NewFleet(ctx, config)
+	if config.AdminListen != "" {
+		go func() {
+			err := admin.NewServer(config, devices).ListenAndServe(config.AdminListen)
+			log.Errorf("admin: %s", err)
+		}()
+	}
+	if config.TUI {
+		dashboardDone := make(chan struct{})
+		go func() {
+			defer close(dashboardDone)
+			err := tui.NewDashboard(config, devices).Run(ctx, cancel)
+			if err != nil {
+				log.Errorf("dashboard: %s", err)
+			}
+		}()
+		// restore the terminal before exiting
+		defer func() {
+			cancel()
+			<-dashboardDone
+		}()
+	}
+	go devices.Churn(ctx)
+	err = ramp.Run(ctx, profile, devices)
+	if err != nil || ctx.Err() != nil {
+		return err
+	}
+	log.Info("ramp-down complete, all the clients stopped")
+	return nil
+}
+
+// withSignals returns a context which is canceled on SIGINT or SIGTERM.
+func withSignals(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.Infof("received %s, stopping", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
 
-		time.Sleep(config.StartTime / time.Duration(config.Count))
+// runOpenModel creates all the clients up front and lets the scheduler send
+// the requests on their behalf.
+func runOpenModel(ctx context.Context, config *model.RunConfig) error {
+	clients := make([]*client.Client, config.Count)
+	for i := range clients {
+		var err error
+		clients[i], err = client.NewClient(config, config.IndexOffset+int64(i))
+		if err != nil {
+			return err
+		}
 	}
+	scheduler.NewScheduler(config, clients).Run(ctx)
+	return nil
+}
 
-	select {}
+func issueCertificates(config *model.RunConfig) error {
+	issuer, err := key.NewCertificateIssuer(config)
+	if err != nil {
+		return err
+	}
+	commonNames := make([]string, config.Count)
+	for i := range commonNames {
+		commonNames[i], err = client.GetMACAddressFromPrefixAndIndex(
+			config.MACAddressPrefix, config.IndexOffset+int64(i))
+		if err != nil {
+			return err
+		}
+	}
+	err = issuer.IssueCertificates(commonNames, config.MTLSWorkers)
+	if err != nil {
+		return err
+	}
+	config.CertificateIssuer = issuer
+	return nil
 }
@@ -0,0 +1,201 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package scheduler implements the open load model: instead of each device
+// polling on its own tickers, a global scheduler issues the requests at
+// target rates on behalf of the device pool, regardless of how fast the
+// server answers.
+package scheduler
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/client"
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+const (
+	metricIssued     = "scheduler_issued_total"
+	metricDropped    = "scheduler_dropped_total"
+	metricTargetRate = "scheduler_target_millirps"
+)
+
+type device struct {
+	client        *client.Client
+	authenticated bool
+}
+
+type endpoint struct {
+	operation string
+	rate      float64
+	run       func(ctx context.Context, c *client.Client) error
+	issued    *metrics.Counter
+	dropped   *metrics.Counter
+	completed int64
+}
+
+// Scheduler keeps the idle devices in two free lists, by authentication
+// state; a device is in at most one of them, and in none while busy.
+type Scheduler struct {
+	config          *model.RunConfig
+	authenticated   chan *device
+	unauthenticated chan *device
+	endpoints       []*endpoint
+	inFlight        int64
+}
+
+func NewScheduler(config *model.RunConfig, clients []*client.Client) *Scheduler {
+	s := &Scheduler{
+		config:          config,
+		authenticated:   make(chan *device, len(clients)),
+		unauthenticated: make(chan *device, len(clients)),
+	}
+	for _, c := range clients {
+		s.unauthenticated <- &device{client: c}
+	}
+	s.addEndpoint(client.OperationAuthentication, config.AuthRate,
+		func(ctx context.Context, c *client.Client) error {
+			return c.AuthenticateOnce(ctx)
+		})
+	s.addEndpoint(client.OperationSendInventory, config.InventoryRate,
+		func(ctx context.Context, c *client.Client) error {
+			return c.SendInventory(ctx)
+		})
+	s.addEndpoint(client.OperationUpdateCheck, config.UpdateRate,
+		func(ctx context.Context, c *client.Client) error {
+			return c.UpdateCheck(ctx)
+		})
+	return s
+}
+
+func (s *Scheduler) addEndpoint(operation string, rate float64,
+	run func(ctx context.Context, c *client.Client) error) {
+	if rate <= 0 {
+		return
+	}
+	// in thousandths of requests per second, for the fractional rates
+	metrics.GetGauge(metricTargetRate, "operation", operation).
+		Set(int64(math.Round(rate * 1000)))
+	s.endpoints = append(s.endpoints, &endpoint{
+		operation: operation,
+		rate:      rate,
+		run:       run,
+		issued:    metrics.GetCounter(metricIssued, "operation", operation),
+		dropped:   metrics.GetCounter(metricDropped, "operation", operation),
+	})
+}
+
+// Run issues the requests until the context is canceled.
+func (s *Scheduler) Run(ctx context.Context) {
+	for _, e := range s.endpoints {
+		go s.generate(ctx, e)
+	}
+	s.report(ctx)
+}
+
+func (s *Scheduler) generate(ctx context.Context, e *endpoint) {
+	bucket := newTokenBucket(e.rate, s.config.RateBurst)
+	for bucket.wait(ctx) == nil {
+		if atomic.LoadInt64(&s.inFlight) >= int64(s.config.MaxInFlight) {
+			e.dropped.Inc()
+			continue
+		}
+		d := s.acquire(e.operation == client.OperationAuthentication)
+		if d == nil {
+			e.dropped.Inc()
+			continue
+		}
+		e.issued.Inc()
+		atomic.AddInt64(&s.inFlight, 1)
+		go s.dispatch(ctx, e, d)
+	}
+}
+
+func (s *Scheduler) dispatch(ctx context.Context, e *endpoint, d *device) {
+	err := e.run(ctx, d.client)
+	if err == client.ErrUnauthorized {
+		d.authenticated = false
+	} else if err == nil && e.operation == client.OperationAuthentication {
+		d.authenticated = true
+	}
+	atomic.AddInt64(&e.completed, 1)
+	atomic.AddInt64(&s.inFlight, -1)
+	s.release(d)
+}
+
+// acquire reserves the next idle device: an authenticated one for the
+// regular requests and, preferably, an unauthenticated one for the
+// authentication requests.
+func (s *Scheduler) acquire(authentication bool) *device {
+	if authentication {
+		select {
+		case d := <-s.unauthenticated:
+			return d
+		default:
+		}
+	}
+	select {
+	case d := <-s.authenticated:
+		return d
+	default:
+		return nil
+	}
+}
+
+// release puts the device back in the free list of its authentication state.
+func (s *Scheduler) release(d *device) {
+	if d.authenticated {
+		s.authenticated <- d
+	} else {
+		s.unauthenticated <- d
+	}
+}
+
+func (s *Scheduler) report(ctx context.Context) {
+	ticker := time.NewTicker(s.config.ReportInterval)
+	defer ticker.Stop()
+	last := make(map[string][3]int64, len(s.endpoints))
+	lastTime := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(lastTime).Seconds()
+			lastTime = now
+			for _, e := range s.endpoints {
+				current := [3]int64{
+					e.issued.Value(),
+					atomic.LoadInt64(&e.completed),
+					e.dropped.Value(),
+				}
+				previous := last[e.operation]
+				last[e.operation] = current
+				log.Infof("%-15s target %8.1f rps, issued %8.1f rps, "+
+					"completed %8.1f rps, dropped %6d, in flight %6d",
+					e.operation, e.rate,
+					float64(current[0]-previous[0])/elapsed,
+					float64(current[1]-previous[1])/elapsed,
+					current[2]-previous[2],
+					atomic.LoadInt64(&s.inFlight))
+			}
+		}
+	}
+}
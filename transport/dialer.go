@@ -0,0 +1,147 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+	"github.com/mendersoftware/mender-stress-test-client/model"
+	"github.com/mendersoftware/mender-stress-test-client/netem"
+)
+
+const (
+	// SourceAddressAssignmentRoundRobin binds each new connection to the
+	// next source address of the pool
+	SourceAddressAssignmentRoundRobin = "round-robin"
+	// SourceAddressAssignmentDevice binds all the connections of a device
+	// to the same source address, chosen by device index
+	SourceAddressAssignmentDevice = "device"
+)
+
+const (
+	metricConnections      = "connections"
+	metricConnectionsTotal = "connections_total"
+)
+
+var sourceAddressCounter uint64
+
+type dialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ParseSourceAddresses expands the given IP addresses and interface names to
+// the pool of source addresses to bind the outgoing connections to.
+func ParseSourceAddresses(sources []string) ([]net.IP, error) {
+	addresses := []net.IP{}
+	for _, source := range sources {
+		if ip := net.ParseIP(source); ip != nil {
+			addresses = append(addresses, ip)
+			continue
+		}
+		iface, err := net.InterfaceByName(source)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid source address %s", source)
+		}
+		ifaceAddresses, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, addr := range ifaceAddresses {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !ipNet.IP.IsGlobalUnicast() {
+				continue
+			}
+			addresses = append(addresses, ipNet.IP)
+			found = true
+		}
+		if !found {
+			return nil, errors.Errorf("no usable address on interface %s", source)
+		}
+	}
+	return addresses, nil
+}
+
+// DeviceSourceAddress returns the source address the connections of the
+// device with the given index are bound to, or nil if the address is picked
+// for each connection.
+func DeviceSourceAddress(config *model.RunConfig, index int64) net.IP {
+	if len(config.SourceAddresses) == 0 ||
+		config.SourceAddressAssignment != SourceAddressAssignmentDevice {
+		return nil
+	}
+	return config.SourceAddresses[index%int64(len(config.SourceAddresses))]
+}
+
+func newDialContext(config *model.RunConfig, opts *DeviceOptions) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialer := &net.Dialer{
+			Timeout:   config.ConnectTimeout,
+			KeepAlive: dialKeepAlive,
+		}
+		source := opts.SourceAddress
+		if source == nil && len(config.SourceAddresses) > 0 {
+			n := atomic.AddUint64(&sourceAddressCounter, 1)
+			source = config.SourceAddresses[n%uint64(len(config.SourceAddresses))]
+		}
+		if source != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: source}
+		}
+
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Network == nil {
+			return newTrackedConn(conn), nil
+		}
+		err = netem.WaitDial(ctx, opts.Network)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return netem.NewConn(newTrackedConn(conn), opts.Network), nil
+	}
+}
+
+// trackedConn keeps count of the open connections per source address.
+type trackedConn struct {
+	net.Conn
+	gauge     *metrics.Gauge
+	closeOnce sync.Once
+}
+
+func newTrackedConn(conn net.Conn) *trackedConn {
+	source := ""
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		source = addr.IP.String()
+	}
+	metrics.GetCounter(metricConnectionsTotal, "source", source).Inc()
+	gauge := metrics.GetGauge(metricConnections, "source", source)
+	gauge.Inc()
+	return &trackedConn{
+		Conn:  conn,
+		gauge: gauge,
+	}
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(c.gauge.Dec)
+	return c.Conn.Close()
+}
@@ -0,0 +1,138 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package transport
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// lifetimeConn is a connection which closes once it reaches the maximum
+// connection lifetime and no request uses it anymore.
+type lifetimeConn struct {
+	net.Conn
+	timer    *time.Timer
+	mutex    sync.Mutex
+	requests int
+	expired  bool
+}
+
+// lifetimeAddr is the local address of a lifetimeConn; it lets the requests
+// find the connection they got, even under the TLS connection.
+type lifetimeAddr struct {
+	net.Addr
+	conn *lifetimeConn
+}
+
+func newLifetimeConn(conn net.Conn, lifetime time.Duration) *lifetimeConn {
+	c := &lifetimeConn{Conn: conn}
+	c.timer = time.AfterFunc(lifetime, c.expire)
+	return c
+}
+
+func (c *lifetimeConn) LocalAddr() net.Addr {
+	return &lifetimeAddr{Addr: c.Conn.LocalAddr(), conn: c}
+}
+
+func (c *lifetimeConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// expire closes the connection if it is idle, otherwise the last request
+// closes it when it completes. The transport drops the closed connections
+// from its pool.
+func (c *lifetimeConn) expire() {
+	c.mutex.Lock()
+	c.expired = true
+	idle := c.requests == 0
+	c.mutex.Unlock()
+	if idle {
+		_ = c.Conn.Close()
+	}
+}
+
+func (c *lifetimeConn) acquire() {
+	c.mutex.Lock()
+	c.requests++
+	c.mutex.Unlock()
+}
+
+func (c *lifetimeConn) release() {
+	c.mutex.Lock()
+	c.requests--
+	expired := c.expired && c.requests == 0
+	c.mutex.Unlock()
+	if expired {
+		_ = c.Conn.Close()
+	}
+}
+
+func withLifetime(dial dialContextFunc, lifetime time.Duration) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newLifetimeConn(conn, lifetime), nil
+	}
+}
+
+// releaseBody releases the connection of the response when it is closed.
+type releaseBody struct {
+	io.ReadCloser
+	once sync.Once
+	conn *lifetimeConn
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.conn.release)
+	return err
+}
+
+// doWithLifetime sends the request, keeping track of the connection it uses
+// until the response body is closed.
+func (c *HTTPClient) doWithLifetime(req *http.Request) (*http.Response, error) {
+	var conn *lifetimeConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			// a retried or redirected request gets another connection
+			if conn != nil {
+				conn.release()
+				conn = nil
+			}
+			if addr, ok := info.Conn.LocalAddr().(*lifetimeAddr); ok {
+				conn = addr.conn
+				conn.acquire()
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	response, err := c.Client.Do(req)
+	if conn == nil {
+		return response, err
+	} else if err != nil {
+		conn.release()
+		return response, err
+	}
+	response.Body = &releaseBody{ReadCloser: response.Body, conn: conn}
+	return response, nil
+}
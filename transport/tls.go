@@ -0,0 +1,98 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package transport
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+const pinPrefix = "sha256/"
+
+var errPinMismatch = errors.New("server public key does not match any pinned key")
+
+// NewTLSConfig builds the TLS client configuration shared by the HTTP and
+// websocket connections.
+func NewTLSConfig(config *model.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.Insecure,
+	}
+
+	if config.CACert != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := ioutil.ReadFile(config.CACert)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %s", config.CACert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(config.PinnedPublicKeys) > 0 {
+		pins := make(map[string]struct{}, len(config.PinnedPublicKeys))
+		for _, pin := range config.PinnedPublicKeys {
+			pin = strings.TrimPrefix(pin, pinPrefix)
+			decoded, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(decoded) != sha256.Size {
+				return nil, errors.Errorf("invalid public key pin: %s", pin)
+			}
+			pins[pin] = struct{}{}
+		}
+		// VerifyConnection runs also when the chain verification is
+		// disabled: the pins then apply to the leaf certificate only, as
+		// the rest of the presented chain proves nothing
+		insecure := config.Insecure
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if insecure {
+				if len(state.PeerCertificates) > 0 &&
+					pinned(pins, state.PeerCertificates[0]) {
+					return nil
+				}
+				return errPinMismatch
+			}
+			for _, chain := range state.VerifiedChains {
+				for _, cert := range chain {
+					if pinned(pins, cert) {
+						return nil
+					}
+				}
+			}
+			return errPinMismatch
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// pinned returns whether the public key of the certificate is pinned.
+func pinned(pins map[string]struct{}, cert *x509.Certificate) bool {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	_, ok := pins[base64.StdEncoding.EncodeToString(sum[:])]
+	return ok
+}
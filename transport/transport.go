@@ -0,0 +1,165 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package transport
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	wslib "github.com/gorilla/websocket"
+
+	"github.com/mendersoftware/mender-stress-test-client/model"
+	"github.com/mendersoftware/mender-stress-test-client/netem"
+)
+
+const (
+	// ModeShared makes all the devices share the same connection pool
+	ModeShared = "shared"
+	// ModeDevice gives each device its own connection pool
+	ModeDevice = "device"
+)
+
+const (
+	HTTPVersion1 = "1.1"
+	HTTPVersion2 = "2"
+)
+
+const (
+	dialKeepAlive   = 30 * time.Second
+	idleConnTimeout = 90 * time.Second
+)
+
+var (
+	sharedClients      = map[string]*HTTPClient{}
+	sharedClientsMutex sync.Mutex
+)
+
+// DeviceOptions holds the connection settings specific to a device.
+type DeviceOptions struct {
+	// Certificate is the client certificate for mutual TLS, if any
+	Certificate *tls.Certificate
+	// Proxy is the proxy the device connects through, if any
+	Proxy *url.URL
+	// SourceAddress is the local address the device's connections are
+	// bound to; if nil, it is picked from the pool for each connection
+	SourceAddress net.IP
+	// Network is the emulated network profile of the device, if any
+	Network *netem.Profile
+}
+
+// HTTPClient is an http.Client which closes its connections once they
+// reach the configured maximum lifetime.
+type HTTPClient struct {
+	*http.Client
+	lifetime time.Duration
+}
+
+// GetHTTPClient returns the HTTP client a device should use: the shared one
+// or a new one with its own connection pool, depending on the transport mode.
+// In the shared mode, the devices using the same proxy, source address and
+// network profile share the pool, while devices presenting a client certificate always get
+// their own pool.
+func GetHTTPClient(config *model.RunConfig, opts *DeviceOptions) *HTTPClient {
+	if config.HTTPTransport == ModeDevice || opts.Certificate != nil {
+		return NewHTTPClient(config, opts)
+	}
+	key := opts.SourceAddress.String()
+	if opts.Proxy != nil {
+		key += "|" + opts.Proxy.String()
+	}
+	if opts.Network != nil {
+		key += fmt.Sprintf("|%p", opts.Network)
+	}
+	sharedClientsMutex.Lock()
+	defer sharedClientsMutex.Unlock()
+	client, ok := sharedClients[key]
+	if !ok {
+		client = NewHTTPClient(config, opts)
+		sharedClients[key] = client
+	}
+	return client
+}
+
+func NewHTTPClient(config *model.RunConfig, opts *DeviceOptions) *HTTPClient {
+	dial := newDialContext(config, opts)
+	if config.HTTPMaxConnectionLifetime > 0 {
+		dial = withLifetime(dial, config.HTTPMaxConnectionLifetime)
+	}
+	transport := &http.Transport{
+		Proxy:                 proxyFunc(opts),
+		DialContext:           dial,
+		TLSClientConfig:       newDeviceTLSConfig(config, opts),
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		IdleConnTimeout:       idleConnTimeout,
+		DisableKeepAlives:     !config.HTTPKeepAlive,
+		ForceAttemptHTTP2:     config.HTTPVersion == HTTPVersion2,
+	}
+	if config.HTTPVersion == HTTPVersion1 {
+		// a non-nil, empty map disables HTTP/2
+		transport.TLSNextProto = map[string]func(string,
+			*tls.Conn) http.RoundTripper{}
+	}
+
+	return &HTTPClient{
+		Client: &http.Client{
+			Transport: transport,
+			Timeout:   config.RequestTimeout,
+		},
+		lifetime: config.HTTPMaxConnectionLifetime,
+	}
+}
+
+// Do sends the request. With a maximum connection lifetime, each connection
+// closes once it is older than the lifetime and the requests using it, in
+// this device or in the others sharing the pool, are complete.
+func (c *HTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if c.lifetime <= 0 {
+		return c.Client.Do(req)
+	}
+	return c.doWithLifetime(req)
+}
+
+// NewWebsocketDialer returns the dialer a device uses to open its websocket
+// connection.
+func NewWebsocketDialer(config *model.RunConfig, opts *DeviceOptions) *wslib.Dialer {
+	dialer := *wslib.DefaultDialer
+	dialer.Proxy = proxyFunc(opts)
+	dialer.NetDialContext = newDialContext(config, opts)
+	// the websocket handshake includes the TLS handshake
+	dialer.HandshakeTimeout = config.RequestTimeout
+	dialer.TLSClientConfig = newDeviceTLSConfig(config, opts)
+	return &dialer
+}
+
+func newDeviceTLSConfig(config *model.RunConfig, opts *DeviceOptions) *tls.Config {
+	tlsConfig := config.TLSClientConfig.Clone()
+	if opts.Certificate != nil {
+		tlsConfig.Certificates = []tls.Certificate{*opts.Certificate}
+	}
+	return tlsConfig
+}
+
+func proxyFunc(opts *DeviceOptions) func(*http.Request) (*url.URL, error) {
+	if opts.Proxy != nil {
+		return http.ProxyURL(opts.Proxy)
+	}
+	return http.ProxyFromEnvironment
+}
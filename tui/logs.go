@@ -0,0 +1,61 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package tui
+
+import (
+	"strings"
+	"sync"
+)
+
+// logBuffer keeps the last lines written to it, to show the logs in the
+// dashboard instead of printing them over it.
+type logBuffer struct {
+	mutex sync.Mutex
+	lines []string
+	size  int
+}
+
+func newLogBuffer(size int) *logBuffer {
+	return &logBuffer{
+		lines: make([]string, 0, size),
+		size:  size,
+	}
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if len(b.lines) == b.size {
+			copy(b.lines, b.lines[1:])
+			b.lines = b.lines[:b.size-1]
+		}
+		b.lines = append(b.lines, line)
+	}
+	return len(p), nil
+}
+
+// Lines returns up to the given number of most recent lines.
+func (b *logBuffer) Lines(n int) []string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if n <= 0 {
+		return nil
+	}
+	if n > len(b.lines) {
+		n = len(b.lines)
+	}
+	return append([]string{}, b.lines[len(b.lines)-n:]...)
+}
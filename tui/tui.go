@@ -0,0 +1,339 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package tui implements the live terminal dashboard of the run.
+package tui
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-stress-test-client/client"
+	"github.com/mendersoftware/mender-stress-test-client/fleet"
+	"github.com/mendersoftware/mender-stress-test-client/metrics"
+	"github.com/mendersoftware/mender-stress-test-client/model"
+)
+
+const (
+	defaultColumns  = 80
+	defaultRows     = 24
+	refreshInterval = time.Second
+	maxLogLines     = 100
+)
+
+const (
+	escapeEnter   = "\x1b[?1049h\x1b[?25l"
+	escapeExit    = "\x1b[?25h\x1b[?1049l"
+	escapeHome    = "\x1b[H"
+	escapeEOL     = "\x1b[K"
+	escapeEOS     = "\x1b[J"
+	escapeBold    = "\x1b[1m"
+	escapeReverse = "\x1b[7m"
+	escapeReset   = "\x1b[0m"
+)
+
+// the request outcome classes shown as columns, in order
+var classes = []string{
+	"2xx",
+	"4xx",
+	"5xx",
+	client.ErrorClassTimeout,
+	client.ErrorClassNetwork,
+	client.ErrorClassCanceled,
+}
+
+// Dashboard shows the state of the fleet and the request statistics,
+// refreshed every second, and controls the fleet with keyboard shortcuts.
+type Dashboard struct {
+	config   *model.RunConfig
+	fleet    *fleet.Fleet
+	logs     *logBuffer
+	start    time.Time
+	previous map[string]operationStats
+	last     time.Time
+}
+
+type operationStats struct {
+	classes  map[string]int64
+	total    int64
+	duration metrics.HistogramSnapshot
+}
+
+func NewDashboard(config *model.RunConfig, fleet *fleet.Fleet) *Dashboard {
+	return &Dashboard{
+		config:   config,
+		fleet:    fleet,
+		logs:     newLogBuffer(maxLogLines),
+		previous: map[string]operationStats{},
+	}
+}
+
+// Run shows the dashboard until the context is canceled or the user quits,
+// in which case it calls stop. The logs are shown in the dashboard while it
+// runs.
+func (d *Dashboard) Run(ctx context.Context, stop context.CancelFunc) error {
+	fd := int(os.Stdin.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	log.SetOutput(d.logs)
+	defer log.SetOutput(os.Stderr)
+
+	out := bufio.NewWriter(os.Stdout)
+	_, _ = out.WriteString(escapeEnter)
+	defer func() {
+		_, _ = out.WriteString(escapeExit)
+		_ = out.Flush()
+	}()
+
+	keys := make(chan byte)
+	go readKeys(keys)
+
+	d.start = time.Now()
+	d.last = d.start
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		d.render(out, fd)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case key := <-keys:
+			if !d.handleKey(key) {
+				stop()
+				return nil
+			}
+		}
+	}
+}
+
+func readKeys(keys chan<- byte) {
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		if n == 1 {
+			keys <- buf[0]
+		}
+	}
+}
+
+// handleKey runs the action bound to the key; it returns false to quit.
+func (d *Dashboard) handleKey(key byte) bool {
+	step := d.config.Count / 10
+	if step < 1 {
+		step = 1
+	}
+	switch key {
+	case 'q', 'Q':
+		return false
+	case 'p', 'P':
+		values := d.config.Settings.Update(func(values *model.SettingsValues) {
+			values.Paused = !values.Paused
+		})
+		log.Infof("polling paused: %t", values.Paused)
+	case '+', '=':
+		d.scale(d.fleet.Size() + step)
+	case '-', '_':
+		d.scale(d.fleet.Size() - step)
+	case 'r', 'R':
+		log.Info("re-authenticating all the devices")
+		d.fleet.Reauthenticate()
+	case 'w', 'W':
+		log.Info("dropping all the websockets")
+		d.fleet.DropWebsockets()
+	}
+	return true
+}
+
+func (d *Dashboard) scale(size int64) {
+	if size < 0 {
+		size = 0
+	}
+	log.Infof("scaling the fleet to %d devices", size)
+	err := d.fleet.Scale(size)
+	if err != nil {
+		log.Errorf("scaling the fleet: %s", err)
+	}
+}
+
+func (d *Dashboard) render(out *bufio.Writer, fd int) {
+	columns, rows := terminalSize(fd)
+	lines := d.lines()
+	logLines := d.logs.Lines(rows - len(lines) - 2)
+	if len(logLines) > 0 {
+		lines = append(lines, "", escapeBold+"LOGS"+escapeReset)
+		lines = append(lines, logLines...)
+	}
+	if len(lines) > rows-1 {
+		lines = lines[:rows-1]
+	}
+
+	_, _ = out.WriteString(escapeHome)
+	for _, line := range lines {
+		_, _ = out.WriteString(truncate(line, columns) + escapeEOL + "\r\n")
+	}
+	_, _ = out.WriteString(escapeEOS)
+	_, _ = out.WriteString(escapeReverse + truncate(" [p] pause/resume  [+/-] add/remove "+
+		"devices  [r] re-authenticate  [w] drop websockets  [q] quit", columns) +
+		escapeReset)
+	_ = out.Flush()
+}
+
+func (d *Dashboard) lines() []string {
+	now := time.Now()
+	elapsed := now.Sub(d.last).Seconds()
+	d.last = now
+
+	settings := d.config.Settings.Get()
+	status := "running"
+	if settings.Paused {
+		status = "paused"
+	}
+	lines := []string{
+		fmt.Sprintf("%smender-stress-test-client%s  %s  uptime %s  %s",
+			escapeBold, escapeReset, d.config.ServerURL,
+			now.Sub(d.start).Truncate(time.Second), status),
+		"",
+		escapeBold + "DEVICES" + escapeReset,
+	}
+
+	states := map[string]int64{}
+	for _, sample := range metrics.Find(client.MetricDeviceState) {
+		states[sample.Labels["state"]] = sample.Value
+	}
+	lines = append(lines, fmt.Sprintf(
+		"  running %8d   authenticating %8d   idle %8d   deploying %8d   "+
+			"websocket %8d",
+		d.fleet.Size(), states[client.StateAuthenticating],
+		states[client.StateIdle], states[client.StateDeploying],
+		metrics.GetGauge(client.MetricWebsockets).Value()))
+
+	lines = append(lines, "", escapeBold+d.requestsHeader()+escapeReset)
+	lines = append(lines, d.requests(elapsed)...)
+
+	deployments := map[string]int64{}
+	for _, sample := range metrics.Find(client.MetricDeployments) {
+		deployments[sample.Labels["result"]] = sample.Value
+	}
+	lines = append(lines, "", escapeBold+"DEPLOYMENTS"+escapeReset,
+		fmt.Sprintf("  in progress %8d   succeeded %8d   failed %8d",
+			states[client.StateDeploying], deployments[client.DeploymentSuccess],
+			deployments[client.DeploymentFailure]))
+	return lines
+}
+
+func (d *Dashboard) requestsHeader() string {
+	header := fmt.Sprintf("%-20s %8s %8s %8s %8s", "REQUESTS", "rps", "p50",
+		"p90", "p99")
+	for _, class := range classes {
+		header += fmt.Sprintf(" %9s", class)
+	}
+	return header
+}
+
+// requests returns one line per operation with the request rate and the
+// latency percentiles since the previous refresh, and the total number of
+// requests per class.
+func (d *Dashboard) requests(elapsed float64) []string {
+	current := map[string]operationStats{}
+	for _, sample := range metrics.Find(client.MetricRequests) {
+		operation := sample.Labels["operation"]
+		stats, ok := current[operation]
+		if !ok {
+			stats.classes = map[string]int64{}
+		}
+		stats.classes[sample.Labels["class"]] += sample.Value
+		stats.total += sample.Value
+		current[operation] = stats
+	}
+	for _, sample := range metrics.Find(client.MetricRequestDuration) {
+		operation := sample.Labels["operation"]
+		if stats, ok := current[operation]; ok && sample.Histogram != nil {
+			stats.duration = sample.Histogram.Snapshot()
+			current[operation] = stats
+		}
+	}
+
+	operations := make([]string, 0, len(current))
+	for operation := range current {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+
+	lines := make([]string, 0, len(operations))
+	for _, operation := range operations {
+		stats := current[operation]
+		previous := d.previous[operation]
+		duration := stats.duration.Sub(previous.duration)
+		rps := 0.0
+		if elapsed > 0 {
+			rps = float64(stats.total-previous.total) / elapsed
+		}
+		line := fmt.Sprintf("  %-18s %8.1f %8s %8s %8s", operation, rps,
+			formatDuration(duration.Quantile(0.5)),
+			formatDuration(duration.Quantile(0.9)),
+			formatDuration(duration.Quantile(0.99)))
+		for _, class := range classes {
+			line += fmt.Sprintf(" %9d", stats.classes[class])
+		}
+		lines = append(lines, line)
+	}
+	d.previous = current
+	return lines
+}
+
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	} else if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%.1fs", d.Seconds())
+}
+
+// truncate cuts the line to the given number of visible characters,
+// skipping the escape sequences.
+func truncate(line string, columns int) string {
+	var b strings.Builder
+	visible := 0
+	escape := false
+	for _, r := range line {
+		switch {
+		case r == '\x1b':
+			escape = true
+		case escape:
+			escape = r == '[' || r == '?' || (r >= '0' && r <= '9') || r == ';'
+		case visible == columns:
+			return b.String() + escapeReset
+		default:
+			visible++
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
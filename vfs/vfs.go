@@ -0,0 +1,238 @@
+// Copyright 2023 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package vfs implements the synthetic filesystem of the devices: the files
+// have a size and permissions, and their content is generated on the fly.
+package vfs
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotFound         = errors.New("no such file or directory")
+	ErrIsDirectory      = errors.New("is a directory")
+	ErrPermissionDenied = errors.New("permission denied")
+	ErrInvalidPath      = errors.New("the path must be absolute")
+)
+
+const defaultMode = 0644
+
+// DefaultFiles are the files of the devices when none are configured.
+var DefaultFiles = []*File{
+	{Path: "/etc/hostname", Size: 32, Mode: 0644},
+	{Path: "/etc/mender/mender.conf", Size: 512, Mode: 0600},
+	{Path: "/var/log/messages", Size: 256 << 10, Mode: 0640},
+	{Path: "/data/firmware.bin", Size: 4 << 20, Mode: 0644},
+}
+
+// File describes a file of the filesystem.
+type File struct {
+	Path    string
+	Size    int64
+	Mode    os.FileMode
+	UID     uint32
+	GID     uint32
+	ModTime time.Time
+	// seed of the generated content
+	seed uint64
+}
+
+// Parse parses a file specification: <path>:<size>[:<mode>], with the size
+// in bytes or with a K, M or G suffix, and the mode in octal.
+func Parse(spec string) (*File, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, errors.Errorf("invalid file specification: %s", spec)
+	}
+	f := &File{
+		Path: path.Clean(parts[0]),
+		Mode: defaultMode,
+	}
+	if !path.IsAbs(f.Path) {
+		return nil, errors.Wrap(ErrInvalidPath, spec)
+	}
+	size, err := parseSize(parts[1])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid file size: %s", spec)
+	}
+	f.Size = size
+	if len(parts) == 3 {
+		mode, err := strconv.ParseUint(parts[2], 8, 32)
+		if err != nil || mode > 0777 {
+			return nil, errors.Errorf("invalid file mode: %s", spec)
+		}
+		f.Mode = os.FileMode(mode)
+	}
+	return f, nil
+}
+
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			multiplier = 1 << 10
+		case 'M', 'm':
+			multiplier = 1 << 20
+		case 'G', 'g':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("the size must be a positive number")
+	}
+	return size * multiplier, nil
+}
+
+// FS is the filesystem of a device. It is not safe for concurrent use, but
+// the files it returns are immutable and can be read concurrently.
+type FS struct {
+	files map[string]*File
+	seed  uint64
+}
+
+// New returns a filesystem with the given files; the seed makes the content
+// of the files different on each device.
+func New(files []*File, seed string) *FS {
+	fs := &FS{
+		files: make(map[string]*File, len(files)),
+		seed:  hash(seed),
+	}
+	now := time.Now().Truncate(time.Second)
+	for _, f := range files {
+		file := *f
+		file.ModTime = now
+		file.seed = fs.seed ^ hash(file.Path)
+		fs.files[file.Path] = &file
+	}
+	return fs
+}
+
+// Stat returns the file or, for the parent directories of the files, a
+// directory.
+func (fs *FS) Stat(name string) (*File, error) {
+	name = path.Clean(name)
+	if !path.IsAbs(name) {
+		return nil, ErrInvalidPath
+	}
+	if f, ok := fs.files[name]; ok {
+		return f, nil
+	}
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for p := range fs.files {
+		if strings.HasPrefix(p, prefix) {
+			return &File{Path: name, Mode: os.ModeDir | 0755, ModTime: time.Now()}, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Open returns the file for reading.
+func (fs *FS) Open(name string) (*File, error) {
+	f, err := fs.Stat(name)
+	if err != nil {
+		return nil, err
+	} else if f.Mode.IsDir() {
+		return nil, ErrIsDirectory
+	} else if f.Mode&0444 == 0 {
+		return nil, ErrPermissionDenied
+	}
+	return f, nil
+}
+
+// CheckWrite returns an error if the file can't be written.
+func (fs *FS) CheckWrite(name string) error {
+	name = path.Clean(name)
+	if !path.IsAbs(name) {
+		return ErrInvalidPath
+	}
+	f, err := fs.Stat(name)
+	if err == ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	} else if f.Mode.IsDir() {
+		return ErrIsDirectory
+	} else if f.Mode&0222 == 0 {
+		return ErrPermissionDenied
+	}
+	return nil
+}
+
+// Create adds or replaces a file of the given size; the content of the
+// file is not kept.
+func (fs *FS) Create(name string, size int64, mode os.FileMode, uid, gid uint32) *File {
+	f := &File{
+		Path:    path.Clean(name),
+		Size:    size,
+		Mode:    mode.Perm(),
+		UID:     uid,
+		GID:     gid,
+		ModTime: time.Now().Truncate(time.Second),
+	}
+	f.seed = fs.seed ^ hash(f.Path) ^ uint64(f.ModTime.UnixNano())
+	fs.files[f.Path] = f
+	return f
+}
+
+// ReadAt fills b with the content of the file at the given offset, and
+// returns the number of bytes read, which is less than len(b) at the end of
+// the file.
+func (f *File) ReadAt(b []byte, offset int64) int {
+	if offset >= f.Size {
+		return 0
+	}
+	if remaining := f.Size - offset; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	var block [8]byte
+	for i := range b {
+		pos := offset + int64(i)
+		if i == 0 || pos%8 == 0 {
+			binary.LittleEndian.PutUint64(block[:], mix(f.seed+uint64(pos/8)))
+		}
+		b[i] = block[pos%8]
+	}
+	return len(b)
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	return h.Sum64()
+}
+
+// mix is the splitmix64 finalizer, which turns a counter into pseudo-random
+// bits.
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -15,7 +15,7 @@
 package websocket
 
 import (
-	"crypto/tls"
+	"context"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -52,22 +52,18 @@ type Connection struct {
 }
 
 // Websocket connection routine. setup the ping-pong and connection settings
-func NewConnection(serverURL string, token string) (*Connection, error) {
+func NewConnection(ctx context.Context, serverURL string, token string,
+	dialer *wslib.Dialer) (*Connection, error) {
 	wsServerURL := "ws" + strings.TrimRight(serverURL[4:], "/")
 	parsedURL, err := url.Parse(wsServerURL + defaultDeviceConnectPath)
 	if err != nil {
 		return nil, err
 	}
 
-	wslib.DefaultDialer.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: true,
-	}
 	var wsconn *wslib.Conn
-	dialer := *wslib.DefaultDialer
-
 	headers := http.Header{}
 	headers.Set("Authorization", "Bearer "+token)
-	wsconn, resp, err := dialer.Dial(parsedURL.String(), headers)
+	wsconn, resp, err := dialer.DialContext(ctx, parsedURL.String(), headers)
 	if err != nil {
 		return nil, err
 	}